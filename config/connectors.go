@@ -0,0 +1,474 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/abstractpaper/manifold/transform"
+	"github.com/abstractpaper/manifold/transform/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"gopkg.in/yaml.v3"
+)
+
+// connectorType builds the sources and destinations of a type from
+// its fields, decoded into a fresh value returned by `spec`. Fields
+// tagged `usage:"source"` or `usage:"destination"` are rejected when
+// they are set on the other kind of connector.
+type connectorType struct {
+	spec        func() interface{}
+	source      func(spec interface{}) (stream.Source, error)
+	destination func(spec interface{}) (stream.Destination, error)
+}
+
+type httpSpec struct {
+	Type   string            `yaml:"type"`
+	Addr   string            `yaml:"addr" usage:"source"`
+	Path   string            `yaml:"path" usage:"source"`
+	URL    string            `yaml:"url" usage:"destination"`
+	Method string            `yaml:"method" usage:"destination"`
+	Header map[string]string `yaml:"header" usage:"destination"`
+	Args   map[string]string `yaml:"args"`
+}
+
+type kafkaSpec struct {
+	Type    string            `yaml:"type"`
+	Brokers []string          `yaml:"brokers"`
+	Topic   string            `yaml:"topic"`
+	GroupID string            `yaml:"groupId" usage:"source"`
+	Args    map[string]string `yaml:"args"`
+}
+
+type kinesisSpec struct {
+	Type         string            `yaml:"type"`
+	Region       string            `yaml:"region"`
+	ConsumerName string            `yaml:"consumerName" usage:"source"`
+	StreamARN    string            `yaml:"streamARN" usage:"source"`
+	Retry        *RetryPolicy      `yaml:"retry" usage:"destination"`
+	Args         map[string]string `yaml:"args"`
+}
+
+type s3Spec struct {
+	Type           string            `yaml:"type"`
+	Region         string            `yaml:"region"`
+	BucketName     string            `yaml:"bucketName"`
+	Folder         string            `yaml:"folder"`
+	CommitFileSize int               `yaml:"commitFileSize"`
+	CommitDuration int               `yaml:"commitDuration"`
+	UploadEvery    int               `yaml:"uploadEvery"`
+	Args           map[string]string `yaml:"args"`
+}
+
+type mqttSpec struct {
+	Type  string            `yaml:"type"`
+	URL   string            `yaml:"url"`
+	Topic string            `yaml:"topic"`
+	Args  map[string]string `yaml:"args"`
+}
+
+type natsSpec struct {
+	Type    string            `yaml:"type"`
+	URL     string            `yaml:"url"`
+	Subject string            `yaml:"subject"`
+	Args    map[string]string `yaml:"args"`
+}
+
+type rabbitMQSpec struct {
+	Type  string            `yaml:"type"`
+	URL   string            `yaml:"url"`
+	Retry *RetryPolicy      `yaml:"retry" usage:"destination"`
+	Args  map[string]string `yaml:"args"`
+}
+
+type webSocketSpec struct {
+	Type      string            `yaml:"type"`
+	URL       string            `yaml:"url"`
+	Header    map[string]string `yaml:"header"`
+	OnConnect []string          `yaml:"onConnect"`
+	Addr      string            `yaml:"addr" usage:"destination"` // serves clients instead of dialing URL
+	Path      string            `yaml:"path" usage:"destination"`
+	Args      map[string]string `yaml:"args"`
+}
+
+type redisSpec struct {
+	Type     string            `yaml:"type"`
+	URL      string            `yaml:"url"`
+	Stream   string            `yaml:"stream"`
+	Group    string            `yaml:"group" usage:"source"`
+	Consumer string            `yaml:"consumer" usage:"source"`
+	Args     map[string]string `yaml:"args"`
+}
+
+type stdioSpec struct {
+	Type string `yaml:"type"`
+}
+
+type jsonSpec struct {
+	Type   string                 `yaml:"type"`
+	Append map[string]interface{} `yaml:"append"`
+}
+
+var connectorTypes = map[string]connectorType{
+	"http": {
+		spec: func() interface{} { return &httpSpec{} },
+		source: func(spec interface{}) (stream.Source, error) {
+			s := spec.(*httpSpec)
+			src := &stream.HTTPServer{Addr: s.Addr, Path: s.Path, Args: s.Args}
+			if s.Addr == "" {
+				return src, errors.New("addr is required")
+			}
+			return src, nil
+		},
+		destination: func(spec interface{}) (stream.Destination, error) {
+			s := spec.(*httpSpec)
+			header := http.Header{}
+			for k, v := range s.Header {
+				header.Set(k, v)
+			}
+			return &stream.HTTP{URL: s.URL, Method: s.Method, Header: header, Args: s.Args}, requireURL(s.URL)
+		},
+	},
+	"kafka": {
+		spec: func() interface{} { return &kafkaSpec{} },
+		source: func(spec interface{}) (stream.Source, error) {
+			s := spec.(*kafkaSpec)
+			k, err := kafka(s)
+			if s.GroupID == "" {
+				err = join(err, errors.New("groupId is required"))
+			}
+			return k, err
+		},
+		destination: func(spec interface{}) (stream.Destination, error) {
+			return kafka(spec.(*kafkaSpec))
+		},
+	},
+	"kinesis": {
+		spec: func() interface{} { return &kinesisSpec{} },
+		source: func(spec interface{}) (stream.Source, error) {
+			s := spec.(*kinesisSpec)
+			sess, err := awsSession(s.Region)
+			return &stream.Kinesis{ConsumerName: s.ConsumerName, StreamARN: s.StreamARN, AWSSess: sess, Args: s.Args}, err
+		},
+		destination: func(spec interface{}) (stream.Destination, error) {
+			s := spec.(*kinesisSpec)
+			sess, err := awsSession(s.Region)
+			return &stream.Kinesis{AWSSess: sess, Args: s.Args, Retry: s.Retry.policy()}, err
+		},
+	},
+	"s3": {
+		spec: func() interface{} { return &s3Spec{} },
+		destination: func(spec interface{}) (stream.Destination, error) {
+			s := spec.(*s3Spec)
+			if s.BucketName == "" {
+				return nil, errors.New("bucketName is required")
+			}
+			sess, err := awsSession(s.Region)
+			return &stream.S3{
+				Region:     s.Region,
+				BucketName: s.BucketName,
+				Config: &stream.S3Config{
+					Folder:         s.Folder,
+					CommitFileSize: s.CommitFileSize,
+					CommitDuration: s.CommitDuration,
+					UploadEvery:    s.UploadEvery,
+				},
+				Args: s.Args,
+				Sess: sess,
+			}, err
+		},
+	},
+	"mqtt": {
+		spec: func() interface{} { return &mqttSpec{} },
+		source: func(spec interface{}) (stream.Source, error) {
+			return mqtt(spec.(*mqttSpec))
+		},
+		destination: func(spec interface{}) (stream.Destination, error) {
+			return mqtt(spec.(*mqttSpec))
+		},
+	},
+	"nats": {
+		spec: func() interface{} { return &natsSpec{} },
+		source: func(spec interface{}) (stream.Source, error) {
+			return nats(spec.(*natsSpec))
+		},
+		destination: func(spec interface{}) (stream.Destination, error) {
+			return nats(spec.(*natsSpec))
+		},
+	},
+	"rabbitmq": {
+		spec: func() interface{} { return &rabbitMQSpec{} },
+		source: func(spec interface{}) (stream.Source, error) {
+			s := spec.(*rabbitMQSpec)
+			return &stream.RabbitMQ{URL: s.URL, Args: s.Args}, requireURL(s.URL)
+		},
+		destination: func(spec interface{}) (stream.Destination, error) {
+			s := spec.(*rabbitMQSpec)
+			return &stream.RabbitMQ{URL: s.URL, Args: s.Args, Retry: s.Retry.policy()}, requireURL(s.URL)
+		},
+	},
+	"redis": {
+		spec: func() interface{} { return &redisSpec{} },
+		source: func(spec interface{}) (stream.Source, error) {
+			s := spec.(*redisSpec)
+			r, err := redisStream(s)
+			if s.Group == "" {
+				err = join(err, errors.New("group is required"))
+			}
+			return r, err
+		},
+		destination: func(spec interface{}) (stream.Destination, error) {
+			return redisStream(spec.(*redisSpec))
+		},
+	},
+	"websocket": {
+		spec: func() interface{} { return &webSocketSpec{} },
+		source: func(spec interface{}) (stream.Source, error) {
+			return webSocket(spec.(*webSocketSpec))
+		},
+		destination: func(spec interface{}) (stream.Destination, error) {
+			s := spec.(*webSocketSpec)
+			if s.Addr != "" {
+				return webSocketServer(s)
+			}
+			return webSocket(s)
+		},
+	},
+	"stdio": {
+		spec: func() interface{} { return &stdioSpec{} },
+		source: func(spec interface{}) (stream.Source, error) {
+			return &stream.Stdio{}, nil
+		},
+		destination: func(spec interface{}) (stream.Destination, error) {
+			return &stream.Stdio{}, nil
+		},
+	},
+}
+
+func (c *Connector) source() (src stream.Source, err error) {
+	t, spec, err := c.decode()
+	if spec == nil {
+		return
+	}
+	if t.source == nil {
+		return nil, fmt.Errorf("%s can't be used as a source", c.Type)
+	}
+	src, e := t.source(spec)
+	return src, join(err, inapplicable(spec, "source"), validateArgs(src, spec, stream.SourceOnly), e)
+}
+
+func (c *Connector) destination() (dest stream.Destination, err error) {
+	t, spec, err := c.decode()
+	if spec == nil {
+		return
+	}
+	if t.destination == nil {
+		return nil, fmt.Errorf("%s can't be used as a destination", c.Type)
+	}
+	dest, e := t.destination(spec)
+	return dest, join(err, inapplicable(spec, "destination"), validateArgs(dest, spec, stream.DestinationOnly), e)
+}
+
+func (c *Connector) transformer() (transform.Transformer, error) {
+	if c.Type != "json" {
+		return nil, fmt.Errorf("unknown type %q, expected json", c.Type)
+	}
+	var spec jsonSpec
+	if err := decodeStrict(&c.node, &spec); err != nil {
+		return nil, err
+	}
+	return &json.JSON{Append: spec.Append}, nil
+}
+
+// decode decodes the fields of the connector according to its type.
+// `spec` is set if the fields could be decoded, even if some keys
+// are unknown.
+func (c *Connector) decode() (t connectorType, spec interface{}, err error) {
+	if c.node.Kind == 0 {
+		return t, nil, errors.New("missing")
+	}
+	t, ok := connectorTypes[c.Type]
+	if !ok {
+		return t, nil, fmt.Errorf("line %d: unknown type %q, expected one of %s", c.node.Line, c.Type, strings.Join(typeNames(), ", "))
+	}
+	spec = t.spec()
+	err = decodeStrict(&c.node, spec)
+	var errs Errors
+	if err != nil && !errors.As(err, &errs) {
+		spec = nil
+	}
+	return
+}
+
+// decodeStrict decodes `node` into the struct pointed to by `v`. Keys
+// that don't match its fields are returned as Errors.
+func decodeStrict(node *yaml.Node, v interface{}) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping", node.Line)
+	}
+
+	known := map[string]bool{}
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		known[strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]] = true
+	}
+
+	var errs Errors
+	for i := 0; i < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if !known[key.Value] {
+			errs = append(errs, fmt.Errorf("line %d: unknown key %q", key.Line, key.Value))
+		}
+	}
+	if err := node.Decode(v); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// inapplicable returns an error for each field of `spec` that is
+// set although its `usage` tag isn't `usage`, e.g. the url of an
+// http source.
+func inapplicable(spec interface{}, usage string) error {
+	var errs []error
+	v := reflect.ValueOf(spec).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		only := field.Tag.Get("usage")
+		if only == "" || only == usage || v.Field(i).IsZero() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		errs = append(errs, fmt.Errorf("%s is only supported by %ss", name, only))
+	}
+	return join(errs...)
+}
+
+// validateArgs checks the `Args` field of `spec` against the options
+// of `connector` used as `usage`, if it declares them.
+func validateArgs(connector interface{}, spec interface{}, usage stream.Usage) error {
+	c, ok := connector.(stream.Configurable)
+	if !ok {
+		return nil
+	}
+	field := reflect.ValueOf(spec).Elem().FieldByName("Args")
+	if !field.IsValid() {
+		return nil
+	}
+	args := field.Interface().(map[string]string)
+
+	var optsErr *stream.OptionsError
+	if err := c.Options().Validate(args, usage); !errors.As(err, &optsErr) {
+		return err
+	}
+	var errs Errors
+	for _, problem := range optsErr.Problems {
+		errs = append(errs, errors.New(problem))
+	}
+	return errs
+}
+
+// join returns the non-nil errors in `errs` as Errors, flattening
+// the ones that are Errors themselves, or nil if there are none.
+func join(errs ...error) error {
+	var joined Errors
+	for _, err := range errs {
+		var list Errors
+		if errors.As(err, &list) {
+			joined = append(joined, list...)
+		} else if err != nil {
+			joined = append(joined, err)
+		}
+	}
+	if len(joined) > 0 {
+		return joined
+	}
+	return nil
+}
+
+func requireURL(url string) error {
+	if url == "" {
+		return errors.New("url is required")
+	}
+	return nil
+}
+
+func kafka(s *kafkaSpec) (*stream.Kafka, error) {
+	var errs []error
+	if len(s.Brokers) == 0 {
+		errs = append(errs, errors.New("brokers is required"))
+	}
+	if s.Topic == "" {
+		errs = append(errs, errors.New("topic is required"))
+	}
+	return &stream.Kafka{Brokers: s.Brokers, Topic: s.Topic, GroupID: s.GroupID, Args: s.Args}, join(errs...)
+}
+
+func redisStream(s *redisSpec) (*stream.RedisStream, error) {
+	r := &stream.RedisStream{URL: s.URL, Stream: s.Stream, Group: s.Group, Consumer: s.Consumer, Args: s.Args}
+	if s.Stream == "" {
+		return r, join(requireURL(s.URL), errors.New("stream is required"))
+	}
+	return r, requireURL(s.URL)
+}
+
+func mqtt(s *mqttSpec) (*stream.MQTT, error) {
+	m := &stream.MQTT{URL: s.URL, Topic: s.Topic, Args: s.Args}
+	if s.Topic == "" {
+		return m, join(requireURL(s.URL), errors.New("topic is required"))
+	}
+	return m, requireURL(s.URL)
+}
+
+func nats(s *natsSpec) (*stream.NATS, error) {
+	n := &stream.NATS{URL: s.URL, Subject: s.Subject, Args: s.Args}
+	if s.Subject == "" {
+		return n, join(requireURL(s.URL), errors.New("subject is required"))
+	}
+	return n, requireURL(s.URL)
+}
+
+func webSocket(s *webSocketSpec) (*stream.WebSocket, error) {
+	header := http.Header{}
+	for k, v := range s.Header {
+		header.Set(k, v)
+	}
+	return &stream.WebSocket{URL: s.URL, Header: header, OnConnect: s.OnConnect, Args: s.Args}, requireURL(s.URL)
+}
+
+// webSocketServer returns the server described by `s`, which can't
+// have the keys of a client as well.
+func webSocketServer(s *webSocketSpec) (*stream.WebSocketServer, error) {
+	var errs []error
+	if s.URL != "" {
+		errs = append(errs, errors.New("url can't be used with addr"))
+	}
+	if len(s.Header) > 0 {
+		errs = append(errs, errors.New("header can't be used with addr"))
+	}
+	if len(s.OnConnect) > 0 {
+		errs = append(errs, errors.New("onConnect can't be used with addr"))
+	}
+	return &stream.WebSocketServer{Addr: s.Addr, Path: s.Path, Args: s.Args}, join(errs...)
+}
+
+// awsSession returns a session for `region`, credentials are read
+// from the environment.
+func awsSession(region string) (*session.Session, error) {
+	return session.NewSession(&aws.Config{Region: aws.String(region)})
+}
+
+func typeNames() (names []string) {
+	for name := range connectorTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 
@@ -38,6 +39,7 @@ func main() {
 		StreamARN:    "arn:aws:kinesis:us-east-1:999999999999:stream/test",
 		AWSSess:      sess,
 		Args: map[string]string{
+			"streamName":    "test",
 			"shardId":       "shardId-000000000000",
 			"shardIterator": "LATEST",
 		},
@@ -45,9 +47,16 @@ func main() {
 
 	dest := stream.Stdio{}
 
-	stream.Flow(&src, nil, &dest)
+	// stop the pipeline on interrupt signals
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-interrupt
+		log.Info("Interrupt received.")
+		cancel()
+	}()
 
-	// wait for interrupt signals
-	<-interrupt
-	log.Info("Interrupt received.")
+	err = stream.FlowContext(ctx, &src, nil, &dest)
+	if err != nil {
+		log.Fatalln("Pipeline failed: ", err)
+	}
 }
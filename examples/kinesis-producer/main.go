@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 
@@ -43,9 +44,16 @@ func main() {
 		},
 	}
 
-	stream.Flow(&src, nil, &dest)
+	// stop the pipeline on interrupt signals
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-interrupt
+		log.Info("Interrupt received.")
+		cancel()
+	}()
 
-	// wait for interrupt signals
-	<-interrupt
-	log.Info("Interrupt received.")
+	err = stream.FlowContext(ctx, &src, nil, &dest)
+	if err != nil {
+		log.Fatalln("Pipeline failed: ", err)
+	}
 }
@@ -2,8 +2,18 @@ package stream
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 
@@ -15,19 +25,154 @@ type Kinesis struct {
 	StreamARN    string
 	AWSSess      *session.Session
 	Args         map[string]string
+	Retry        *RetryPolicy // overrides Pipeline.Retry if set
 	client       *kinesis.Kinesis
 	consumer     *kinesis.Consumer
+	mu           sync.Mutex // guards stream and stop
 	stream       *kinesis.SubscribeToShardEventStream
+	stop         chan struct{} // closed on Stop
+	done         chan struct{} // closed on Disconnect
+	checkpoint   *checkpoint
+	health       healthState
+}
+
+// openKinesis returns a Kinesis for a kinesis://stream URI. The
+// `region` query parameter sets the region of its AWS session, `arn`
+// is an alias for StreamARN and `shard` for the `shardId` arg.
+func openKinesis(u *url.URL) (k *Kinesis, err error) {
+	k = &Kinesis{}
+	k.Args, err = setFields(k, query(u))
+	if err != nil {
+		return nil, err
+	}
+	if arn, ok := k.Args["arn"]; ok {
+		k.StreamARN = arn
+		delete(k.Args, "arn")
+	}
+	if shard, ok := k.Args["shard"]; ok {
+		k.Args["shardId"] = shard
+		delete(k.Args, "shard")
+	}
+	k.Args["streamName"] = u.Host
+
+	region := k.Args["region"]
+	delete(k.Args, "region")
+	k.AWSSess, err = session.NewSession(&aws.Config{Region: aws.String(region)})
+	return
+}
+
+// resolveConsumer sets StreamARN from the `streamName` arg and
+// ConsumerName from the host name and `shardID` if they are empty.
+func (k *Kinesis) resolveConsumer(shardID string) (err error) {
+	if k.StreamARN == "" {
+		name, ok := k.Args["streamName"]
+		if !ok {
+			return Permanent(errors.New("Kinesis: StreamARN or streamName must be specified"))
+		}
+		var out *kinesis.DescribeStreamSummaryOutput
+		out, err = k.client.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String(name)})
+		if err != nil {
+			return kinesisError(err)
+		}
+		k.StreamARN = aws.StringValue(out.StreamDescriptionSummary.StreamARN)
+	}
+	if k.ConsumerName == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "localhost"
+		}
+		k.ConsumerName = fmt.Sprintf("manifold-%s-%s", host, shardID)
+	}
+	return
+}
+
+// checkpoint keeps the sequence number of the last acked record
+// and persists it to `path`. Records may be acked out of order, the
+// checkpoint only advances past records that were all acked.
+//
+// A single record can't be redelivered, so once a record is nacked
+// the checkpoint stops advancing: after a restart reading resumes
+// from the last record acked before it.
+type checkpoint struct {
+	path     string
+	mu       sync.Mutex
+	sequence string
+	pending  []string        // sequence numbers read, in order, not yet checkpointed
+	acked    map[string]bool // acked sequence numbers in pending
+	dirty    bool
+	frozen   bool
+}
+
+var kinesisOptions = Options{
+	{Name: "shardId", Type: StringOption, Required: true, Usage: SourceOnly, Description: "shard to read from"},
+	{Name: "shardIterator", Type: StringOption, Required: true, Usage: SourceOnly, Description: "where to start reading: LATEST, TRIM_HORIZON, ..."},
+	{Name: "checkpointPath", Type: StringOption, Usage: SourceOnly, Description: "file keeping the last acked sequence number to resume from"},
+	{Name: "streamName", Type: StringOption, Required: true, Description: "stream to read from or put records into, its ARN is looked up if StreamARN is empty"},
+	{Name: "partitionKey", Type: StringOption, Required: true, Usage: DestinationOnly, Description: "partition key of records"},
+	{Name: "keyFromMessage", Type: BoolOption, Default: "false", Usage: DestinationOnly, Description: "partition messages that have a key with it instead of `partitionKey`"},
+}
+
+// Options returns the Args Kinesis accepts.
+func (k *Kinesis) Options() Options {
+	return kinesisOptions
+}
+
+// RetryPolicy returns Retry, see Retrier.
+func (k *Kinesis) RetryPolicy() *RetryPolicy {
+	return k.Retry
 }
 
 func (k *Kinesis) Connect() (err error) {
+	err = kinesisOptions.Validate(k.Args, SourceAndDestination)
+	if err != nil {
+		return fmt.Errorf("Kinesis: %w", err)
+	}
+
 	// kinesis client
     k.client = kinesis.New(k.AWSSess)
+	k.done = make(chan struct{})
+	k.health.connected(nil)
+
+	return
+}
+
+// Stop closes the shard subscription, which closes the channel
+// returned by Read once the records received so far are pushed.
+func (k *Kinesis) Stop() (err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.stop != nil {
+		close(k.stop)
+		k.stop = nil
+	}
+	if k.stream == nil {
+		return
+	}
+
+	log.Info("Closing shard subscription...")
+	err = k.stream.Close()
+	if err != nil {
+		log.Error(err)
+	}
+	k.stream = nil
 
 	return
 }
 
 func (k *Kinesis) Disconnect() (err error) {
+	k.Stop()
+	k.health.disconnected()
+	if k.done != nil {
+		close(k.done)
+		k.done = nil
+	}
+
+	if k.checkpoint != nil {
+		if err := k.checkpoint.save(); err != nil {
+			log.Error("Failed to save checkpoint: ", err)
+		}
+	}
+
 	if k.consumer != nil {
 		log.Info("Deregistering consumer...")
 		_, err = deregisterConsumer(k.client, k.ConsumerName, k.StreamARN)
@@ -39,11 +184,45 @@ func (k *Kinesis) Disconnect() (err error) {
 	return
 }
 
+// Health reports whether the shard subscription is working, when a
+// record was last read or put and, with a checkpoint, how many
+// records were read but not checkpointed yet.
+func (k *Kinesis) Health() Health {
+	h := k.health.get()
+	if k.checkpoint != nil {
+		h.Backlog = k.checkpoint.backlog()
+	}
+	return h
+}
+
 func (k *Kinesis) Info() {
 	log.Infof("Kinesis.Args: %+v", k.Args)
 }
 
 func (k *Kinesis) Read() (channel chan string, err error) {
+	messages, err := k.ReadMessages()
+	if err != nil {
+		return
+	}
+	return payloads(messages), nil
+}
+
+// ReadMessages is like Read but keeps the partition key, sequence
+// number and arrival timestamp of each record.
+//
+// Subscriptions to the shard expire after 5 minutes or fail, they
+// are renewed from where the previous one stopped until Stop or
+// Disconnect is called, which close the channel.
+//
+// StreamARN is looked up from the `streamName` arg if empty, and
+// ConsumerName defaults to a name made of the host name and shard.
+//
+// Args:
+//   shardId: shard to read from
+//   shardIterator: starting position type, e.g. LATEST
+//   checkpointPath: file to keep the sequence number of the last
+//   acked record in. If it exists, reading resumes after it.
+func (k *Kinesis) ReadMessages() (channel chan Message, err error) {
     shardID, ok := k.Args["shardId"]
     if !ok {
         return nil, errors.New("shardId must be specified in Args.")
@@ -54,60 +233,397 @@ func (k *Kinesis) Read() (channel chan string, err error) {
         return nil, errors.New("shardIterator must be specified in Args.")
     }
 
+	err = k.resolveConsumer(shardID)
+	if err != nil {
+		log.Errorln("Error describing the stream: ", err)
+		return
+	}
+
 	// get a consumer
 	k.consumer, err = getConsumer(k.client, k.ConsumerName, k.StreamARN)
 	if err != nil {
-		log.Fatalln("Error getting a consumer: ", err)
+		log.Errorln("Error getting a consumer: ", err)
 		return
 	}
 
 	// subscribe
 	log.Println("Subscribing to shard.")
-	k.stream, err = shardSubscribe(k.client, k.consumer, shardID, shardIterator)
+	var sequenceNumber string
+	if path, ok := k.Args["checkpointPath"]; ok {
+		k.checkpoint, err = loadCheckpoint(path)
+		if err != nil {
+			log.Errorln("Error loading checkpoint: ", err)
+			return
+		}
+		sequenceNumber = k.checkpoint.sequence
+		if sequenceNumber != "" {
+			log.Info("Resuming after sequence number ", sequenceNumber)
+		}
+	}
+
+	position := startingPosition(shardIterator, sequenceNumber)
+	stream, err := shardSubscribe(k.client, k.consumer, shardID, position)
 	if err != nil {
-		log.Fatalln("Error subscribing to a shard: ", err)
+		log.Errorln("Error subscribing to a shard: ", err)
+		k.health.connected(err)
+		return
 	}
+	stop := make(chan struct{})
+	k.mu.Lock()
+	k.stream, k.stop = stream, stop
+	k.mu.Unlock()
 
 	// loop through stream and push messages into channel
-	channel = make(chan string)
+	channel = make(chan Message)
+	done := k.done
+	if k.checkpoint != nil {
+		go k.checkpoint.saveEvery(time.Second, done)
+	}
 	go func() {
-		log.Println("Looping over event stream...")
-		for e := range k.stream.Reader.Events() {
-			records := e.(*kinesis.SubscribeToShardEvent).Records
+		defer close(channel)
+		for {
+			log.Println("Looping over event stream...")
+			var ok bool
+			position, ok = k.push(stream, shardID, position, channel, done)
+			if !ok {
+				return
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := stream.Err(); err != nil {
+				log.Error("Shard subscription failed: ", err)
+				k.health.connected(err)
+			} else {
+				// subscriptions expire after 5 minutes
+				k.health.disconnected()
+			}
 
-			for _, rec := range records {
-				log.Trace(string(rec.Data))
-				channel <- string(rec.Data)
+			stream = k.resubscribe(shardID, position, stop)
+			if stream == nil {
+				return
 			}
 		}
 	}()
 	return
 }
 
+// push pushes the records of `stream` into channel until the stream
+// ends, and returns the position to resubscribe from. It returns
+// false if `done` was closed.
+func (k *Kinesis) push(stream *kinesis.SubscribeToShardEventStream, shardID string, position *kinesis.StartingPosition, channel chan Message, done chan struct{}) (*kinesis.StartingPosition, bool) {
+	for e := range stream.Reader.Events() {
+		event, ok := e.(*kinesis.SubscribeToShardEvent)
+		if !ok {
+			continue
+		}
+		if event.MillisBehindLatest != nil {
+			kinesisMillisBehind.WithLabelValues(shardID).Set(float64(*event.MillisBehindLatest))
+		}
+		if len(event.Records) > 0 {
+			k.health.read()
+		}
+
+		for _, rec := range event.Records {
+			log.Trace(string(rec.Data))
+			message := recordMessage(rec, shardID)
+			if k.checkpoint != nil {
+				message = message.WithAcknowledger(k.checkpoint.acker(message.Offset))
+			}
+
+			select {
+			case channel <- message:
+			case <-done:
+				return position, false
+			}
+		}
+
+		// the records of the event were all pushed
+		if event.ContinuationSequenceNumber != nil {
+			position = &kinesis.StartingPosition{
+				Type:           aws.String(kinesis.ShardIteratorTypeAtSequenceNumber),
+				SequenceNumber: event.ContinuationSequenceNumber,
+			}
+		}
+	}
+	return position, true
+}
+
+// resubscribe subscribes to the shard again at `position`, waiting
+// between attempts for a period that starts with 1 second and
+// doubles up to 1 minute. It returns nil once `stop` is closed.
+func (k *Kinesis) resubscribe(shardID string, position *kinesis.StartingPosition, stop chan struct{}) *kinesis.SubscribeToShardEventStream {
+	delay := time.Second
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		log.Info("Renewing shard subscription...")
+		stream, err := shardSubscribe(k.client, k.consumer, shardID, position)
+		if err == nil {
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			select {
+			case <-stop:
+				stream.Close()
+				return nil
+			default:
+			}
+			k.stream = stream
+			k.health.connected(nil)
+			return stream
+		}
+
+		log.Error("Failed to renew shard subscription: ", err)
+		k.health.connected(err)
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(delay):
+		}
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+}
+
 func (k *Kinesis) Write(message string) (err error) {
-    partitionKey, ok := k.Args["partitionKey"]
+	return k.WriteMessage(NewMessage(message))
+}
+
+// WriteMessage puts `message` into the stream like Write. With
+// `keyFromMessage`, the key of `message` (if set) is the partition
+// key instead of `partitionKey`.
+func (k *Kinesis) WriteMessage(message Message) (err error) {
+    partitionKey, ok := k.partitionKey(message)
     if !ok {
-        return errors.New("partitionKey must be specified in Args.")
+        return Fatal(errors.New("partitionKey must be specified in Args."))
     }
 
     streamName, ok := k.Args["streamName"]
     if !ok {
-        return errors.New("streamName must be specified in Args.")
+        return Fatal(errors.New("streamName must be specified in Args."))
     }
 
 	record := kinesis.PutRecordInput{
-		Data:         []byte(message),
+		Data:         message.Payload,
 		PartitionKey: &partitionKey,
 		StreamName:   &streamName,
 	}
 	_, err = k.client.PutRecord(&record)
 	if err != nil {
 		log.Errorln("PutRecord failed: ", err)
+		err = kinesisError(err)
+		return
     }
+	k.health.wrote()
 
 	return
 }
 
+// WriteBatch puts `messages` into the stream with PutRecords calls
+// of up to 500 records, partitioned like WriteMessage.
+// Records rejected by Kinesis, e.g. because the shard's throughput
+// was exceeded, are reported in a *BatchError.
+func (k *Kinesis) WriteBatch(messages []Message) (err error) {
+	streamName, ok := k.Args["streamName"]
+	if !ok {
+		return Fatal(errors.New("streamName must be specified in Args."))
+	}
+
+	records := make([]*kinesis.PutRecordsRequestEntry, len(messages))
+	for i, message := range messages {
+		partitionKey, ok := k.partitionKey(message)
+		if !ok {
+			return Fatal(errors.New("partitionKey must be specified in Args."))
+		}
+		records[i] = &kinesis.PutRecordsRequestEntry{
+			Data:         message.Payload,
+			PartitionKey: aws.String(partitionKey),
+		}
+	}
+
+	errs := make([]error, len(messages))
+	var failed bool
+	for start := 0; start < len(records); start += 500 {
+		end := start + 500
+		if end > len(records) {
+			end = len(records)
+		}
+
+		var out *kinesis.PutRecordsOutput
+		out, err = k.client.PutRecords(&kinesis.PutRecordsInput{
+			Records:    records[start:end],
+			StreamName: aws.String(streamName),
+		})
+		if err != nil {
+			log.Errorln("PutRecords failed: ", err)
+			err = kinesisError(err)
+			if start == 0 {
+				return
+			}
+			// earlier records were written
+			for i := start; i < len(records); i++ {
+				errs[i] = err
+			}
+			return &BatchError{Errors: errs}
+		}
+
+		for i, rec := range out.Records {
+			if rec.ErrorCode != nil {
+				errs[start+i] = awserr.New(*rec.ErrorCode, aws.StringValue(rec.ErrorMessage), nil)
+				failed = true
+			}
+		}
+	}
+
+	k.health.wrote()
+	if failed {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
+
+// partitionKey returns the partition key of `message`, and whether
+// there is one.
+func (k *Kinesis) partitionKey(message Message) (string, bool) {
+	if message.Key != "" && kinesisOptions.Bool(k.Args, "keyFromMessage") {
+		return message.Key, true
+	}
+	partitionKey, ok := k.Args["partitionKey"]
+	return partitionKey, ok
+}
+
+// kinesisError marks AWS errors that aren't throttling or otherwise
+// retryable, such as validation errors, as permanent.
+func kinesisError(err error) error {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return err
+	}
+	if _, ok := err.(awserr.RequestFailure); ok {
+		return Permanent(err)
+	}
+	return err
+}
+
+// recordMessage converts a record read from `shardID` into a message.
+func recordMessage(rec *kinesis.Record, shardID string) Message {
+	message := Message{
+		Payload:   rec.Data,
+		Key:       aws.StringValue(rec.PartitionKey),
+		Timestamp: aws.TimeValue(rec.ApproximateArrivalTimestamp),
+		Offset:    aws.StringValue(rec.SequenceNumber),
+		Metadata: map[string]string{
+			"shardId": shardID,
+		},
+	}
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+	return message
+}
+
+// loadCheckpoint reads the sequence number saved in `path`, if any.
+func loadCheckpoint(path string) (c *checkpoint, err error) {
+	c = &checkpoint{path: path, acked: map[string]bool{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.sequence = strings.TrimSpace(string(data))
+	return
+}
+
+// acker tracks the record with `sequence`, which must be called in
+// read order. Acking it advances the checkpoint up to the last record
+// acked in order, nacking it freezes the checkpoint.
+func (c *checkpoint) acker(sequence string) Acknowledger {
+	c.mu.Lock()
+	c.pending = append(c.pending, sequence)
+	c.mu.Unlock()
+
+	return ackFuncs{
+		ack: func() error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.frozen {
+				return nil
+			}
+			c.acked[sequence] = true
+			for len(c.pending) > 0 && c.acked[c.pending[0]] {
+				c.sequence = c.pending[0]
+				delete(c.acked, c.pending[0])
+				c.pending = c.pending[1:]
+				c.dirty = true
+			}
+			return nil
+		},
+		nack: func(err error) error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if !c.frozen {
+				log.Warnf("Record %s was nacked, checkpoint frozen at %s: %v", sequence, c.sequence, err)
+				c.frozen = true
+			}
+			return nil
+		},
+	}
+}
+
+// backlog returns the number of records read but not checkpointed.
+func (c *checkpoint) backlog() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// save writes the sequence number to the checkpoint file if it
+// changed since the last save.
+func (c *checkpoint) save() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(c.path), os.ModePerm)
+	if err != nil {
+		return
+	}
+	tmp := c.path + ".tmp"
+	err = ioutil.WriteFile(tmp, []byte(c.sequence), 0644)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, c.path)
+	if err == nil {
+		c.dirty = false
+	}
+	return
+}
+
+// saveEvery saves the checkpoint every `period` until done is closed.
+func (c *checkpoint) saveEvery(period time.Duration, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(period):
+			if err := c.save(); err != nil {
+				log.Error("Failed to save checkpoint: ", err)
+			}
+		}
+	}
+}
+
 // Return a consumer object
 func getConsumer(svc *kinesis.Kinesis, consumerName string, awsKinesisStreamARN string) (consumer *kinesis.Consumer, err error) {
 	tries := 1
@@ -229,20 +745,34 @@ func deregisterConsumer(svc *kinesis.Kinesis, consumerName string, awsKinesisStr
 }
 
 // Subscribe to a shard on a Kinesis Data Stream.
-func shardSubscribe(svc *kinesis.Kinesis, consumer *kinesis.Consumer, shardId string, shardIteratorType string) (eventStream *kinesis.SubscribeToShardEventStream, err error) {
+// If `sequenceNumber` is set, the subscription starts after it.
+func shardSubscribe(svc *kinesis.Kinesis, consumer *kinesis.Consumer, shardId string, startingPosition *kinesis.StartingPosition) (eventStream *kinesis.SubscribeToShardEventStream, err error) {
 	subscribeInput := kinesis.SubscribeToShardInput{
-		ConsumerARN: consumer.ConsumerARN,
-		ShardId:     &shardId,
-		StartingPosition: &kinesis.StartingPosition{
-			Type: &shardIteratorType,
-		},
+		ConsumerARN:      consumer.ConsumerARN,
+		ShardId:          &shardId,
+		StartingPosition: startingPosition,
 	}
 	// SubscribeToShard
 	out, err := svc.SubscribeToShard(&subscribeInput)
 	if err != nil {
 		log.Error(err)
+		return
 	}
 	eventStream = out.EventStream
 
 	return
 }
+
+// startingPosition returns the position of type `shardIteratorType`,
+// or the one after `sequenceNumber` if set.
+func startingPosition(shardIteratorType string, sequenceNumber string) *kinesis.StartingPosition {
+	if sequenceNumber != "" {
+		return &kinesis.StartingPosition{
+			Type:           aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber),
+			SequenceNumber: &sequenceNumber,
+		}
+	}
+	return &kinesis.StartingPosition{
+		Type: &shardIteratorType,
+	}
+}
@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint_OutOfOrderAcks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+
+	c, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, d := c.acker("1"), c.acker("2"), c.acker("3")
+
+	b.Ack()
+	assert.Equal(t, "", c.sequence)
+	a.Ack()
+	assert.Equal(t, "2", c.sequence)
+	d.Nack(errors.New("failed"))
+	assert.Equal(t, "2", c.sequence)
+
+	assert.NoError(t, c.save())
+	c, err = loadCheckpoint(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", c.sequence)
+}
+
+func TestKinesis_PartitionKey(t *testing.T) {
+	message := Message{Key: "upstream"}
+	k := &Kinesis{Args: map[string]string{"partitionKey": "p1"}}
+	key, _ := k.partitionKey(message)
+	assert.Equal(t, "p1", key)
+
+	k.Args["keyFromMessage"] = "true"
+	key, _ = k.partitionKey(message)
+	assert.Equal(t, "upstream", key)
+	key, _ = k.partitionKey(Message{})
+	assert.Equal(t, "p1", key)
+}
+
+// eventReader replays `events` and then ends like an expired
+// subscription.
+type eventReader struct {
+	events chan kinesis.SubscribeToShardEventStreamEvent
+}
+
+func (r *eventReader) Events() <-chan kinesis.SubscribeToShardEventStreamEvent { return r.events }
+func (r *eventReader) Close() error                                            { return nil }
+func (r *eventReader) Err() error                                              { return nil }
+
+func TestKinesis_PushContinuation(t *testing.T) {
+	reader := &eventReader{events: make(chan kinesis.SubscribeToShardEventStreamEvent, 2)}
+	reader.events <- &kinesis.SubscribeToShardEvent{
+		Records:                    []*kinesis.Record{{Data: []byte("a"), SequenceNumber: aws.String("1"), PartitionKey: aws.String("k")}},
+		ContinuationSequenceNumber: aws.String("2"),
+	}
+	reader.events <- &kinesis.SubscribeToShardEvent{ContinuationSequenceNumber: aws.String("3")}
+	close(reader.events)
+	stream := kinesis.NewSubscribeToShardEventStream(func(s *kinesis.SubscribeToShardEventStream) {
+		s.Reader = reader
+	})
+
+	k := &Kinesis{}
+	channel := make(chan Message, 1)
+	position, ok := k.push(stream, "shardId-0", startingPosition("LATEST", ""), channel, make(chan struct{}))
+
+	assert.True(t, ok)
+	assert.Equal(t, "a", (<-channel).String())
+	// the next subscription starts where this one stopped
+	assert.Equal(t, kinesis.ShardIteratorTypeAtSequenceNumber, aws.StringValue(position.Type))
+	assert.Equal(t, "3", aws.StringValue(position.SequenceNumber))
+}
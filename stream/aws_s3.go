@@ -1,10 +1,16 @@
 package stream
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 
 	"bytes"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
 	"strings"
 	"time"
@@ -23,6 +29,7 @@ type S3 struct {
 	Args       map[string]string
 	Sess       *session.Session
 	buffer     *buffer
+	health     healthState
 }
 
 type S3Config struct {
@@ -34,39 +41,152 @@ type S3Config struct {
 
 type buffer struct {
 	path     string
-	messages chan string
+	messages chan Message
+	pending  int64         // messages written but not yet appended to the buffer file
+	mu       sync.RWMutex  // guards closed
+	closed   bool          // set on Disconnect, Write fails afterwards
+	appended chan struct{} // closed once all messages are appended
+	done     chan struct{} // stops the roller and uploader
+	files    int64         // committed files not uploaded yet
+	progress int64         // time the uploader last made progress, in unix nanoseconds
+}
+
+// openS3 returns an S3 for a s3://bucket/folder URI. Query
+// parameters set the members of S3 and S3Config, e.g. `region` or
+// `commitFileSize`, or become Args.
+func openS3(u *url.URL) (s *S3, err error) {
+	s = &S3{
+		BucketName: u.Host,
+		Config:     &S3Config{Folder: strings.TrimPrefix(u.Path, "/")},
+	}
+	params, err := setFields(s, query(u))
+	if err != nil {
+		return nil, err
+	}
+	s.Args, err = setFields(s.Config, params)
+	if err != nil {
+		return nil, err
+	}
+	s.Sess, err = session.NewSession(&aws.Config{Region: aws.String(s.Region)})
+	return
+}
+
+var s3Options = Options{
+	{Name: "bufferPath", Type: StringOption, Default: "/tmp/manifold/aws_s3/", Description: "directory of the local buffer"},
+}
+
+// Options returns the Args S3 accepts.
+func (s *S3) Options() Options {
+	return s3Options
 }
 
 func (s *S3) Connect() (err error) {
-	s.buffer = &buffer{}
-	// overwrite buffer.path with Args, if specified
-	if val, ok := s.Args["bufferPath"]; ok {
-		s.buffer.path = val
-	} else {
-		// default
-		s.buffer.path = "/tmp/manifold/aws_s3/"
+	err = s3Options.Validate(s.Args, SourceAndDestination)
+	if err != nil {
+		return fmt.Errorf("S3: %w", err)
 	}
 
+	s.buffer = &buffer{}
+	s.buffer.path = s3Options.String(s.Args, "bufferPath")
+
 	// create messages channel
-	s.buffer.messages = make(chan string, 1000)
+	s.buffer.messages = make(chan Message, 1000)
+	s.buffer.appended = make(chan struct{})
+	s.buffer.done = make(chan struct{})
+	s.buffer.progress = time.Now().UnixNano()
 	// create a collector
 	go s.collector()
 	// create an uploader
 	go s.uploader()
+	s.health.connected(nil)
 
 	return
 }
 
+// Disconnect stops accepting messages, waits for the collector to
+// append the ones already written to the buffer and then stops the
+// collector and uploader.
 func (s *S3) Disconnect() (err error) {
+	s.buffer.mu.Lock()
+	if s.buffer.closed {
+		s.buffer.mu.Unlock()
+		return
+	}
+	s.buffer.closed = true
 	close(s.buffer.messages)
+	s.buffer.mu.Unlock()
+
+	<-s.buffer.appended
+	close(s.buffer.done)
+	s.health.disconnected()
 	return
 }
 
+// Health reports when a file was last uploaded and how many messages
+// and files wait to be uploaded. It reports an error if the uploader
+// made no progress for 3 upload periods, and at least a minute.
+func (s *S3) Health() Health {
+	h := s.health.get()
+	if s.buffer == nil {
+		return h
+	}
+	h.Backlog = int(atomic.LoadInt64(&s.buffer.pending) + atomic.LoadInt64(&s.buffer.files))
+
+	stuckAfter := 3 * time.Duration(s.Config.UploadEvery) * time.Second
+	if stuckAfter < time.Minute {
+		stuckAfter = time.Minute
+	}
+	progress := time.Unix(0, atomic.LoadInt64(&s.buffer.progress))
+	if h.Connected && time.Since(progress) > stuckAfter {
+		h.Error = fmt.Sprintf("S3: uploader stuck since %s", progress.Format(time.RFC3339))
+	}
+	return h
+}
+
 func (s *S3) Write(message string) (err error) {
+	return s.WriteMessage(NewMessage(message))
+}
+
+// WriteMessage queues `message` to be appended to the local buffer.
+// The message is acked once appended, see DefersAck.
+func (s *S3) WriteMessage(message Message) (err error) {
+	s.buffer.mu.RLock()
+	defer s.buffer.mu.RUnlock()
+	if s.buffer.closed {
+		return Permanent(errors.New("S3: buffer is closed"))
+	}
+
+	atomic.AddInt64(&s.buffer.pending, 1)
 	s.buffer.messages <- message
 	return
 }
 
+// DefersAck reports that S3 acks messages itself once they are
+// appended to the local buffer rather than when WriteMessage returns.
+func (s *S3) DefersAck() bool {
+	return true
+}
+
+// Flush blocks until every written message is appended to the
+// local buffer, from which it survives restarts until uploaded.
+func (s *S3) Flush(ctx context.Context) (pending int, err error) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pending = int(atomic.LoadInt64(&s.buffer.pending))
+		if pending == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func (s *S3) Info() {
 	log.Info("S3.BucketName: ", s.BucketName)
 	log.Infof("S3Config.CommitFileSize: every %d KB\n", s.Config.CommitFileSize)
@@ -89,6 +209,7 @@ func (s *S3) collector() {
 
 	// read messages from channel and write them to a file
 	go func(bufferPath string) {
+		defer close(s.buffer.appended)
 		for {
 			// read buf.messages channel
 			msg, ok := <-s.buffer.messages
@@ -97,10 +218,14 @@ func (s *S3) collector() {
 			}
 
 			// append (or create) to buffer
-			err = swissIO.AppendFile(bufferPath, msg+"\n")
+			err = swissIO.AppendFile(bufferPath, string(msg.Payload)+"\n")
 			if err != nil {
 				log.Fatal(err)
 			}
+			if err = msg.Ack(); err != nil {
+				log.Error("Failed to ack message: ", err)
+			}
+			atomic.AddInt64(&s.buffer.pending, -1)
 		}
 	}(bufferPath)
 
@@ -108,6 +233,13 @@ func (s *S3) collector() {
 	go func(bufferPath string) {
 		timeCommitted := time.Now()
 		for {
+			// one second interval loop, quit on Disconnect
+			select {
+			case <-s.buffer.done:
+				return
+			case <-time.After(1 * time.Second):
+			}
+
 			// check if file 'buffer' exists
 			exists, err := swissIO.FileExists(bufferPath)
 			if err != nil {
@@ -115,14 +247,14 @@ func (s *S3) collector() {
 			}
 
 			if !exists {
-				// one second interval loop
-				time.Sleep(1 * time.Second)
+				s3BufferBytes.WithLabelValues(s.BucketName).Set(0)
 				continue
 			}
 
 			// commit buffer if it's >= Config.CommitFileSize KB
 			// or time elapsed >= Config.CommitDuration minutes
 			info, err := os.Stat(bufferPath)
+			s3BufferBytes.WithLabelValues(s.BucketName).Set(float64(info.Size()))
 			fileSizeReached := info.Size() >= int64(s.Config.CommitFileSize)*1024
 			durationElapsed := int(time.Since(timeCommitted).Minutes()) >= s.Config.CommitDuration
 			if fileSizeReached || durationElapsed {
@@ -144,6 +276,7 @@ func (s *S3) collector() {
 				}
 
 				timeCommitted = time.Now()
+				s3BufferBytes.WithLabelValues(s.BucketName).Set(0)
 				log.Info("Committed file ", commitPath)
 			}
 		}
@@ -154,6 +287,8 @@ func (s *S3) collector() {
 func (s *S3) uploader() {
 	uploader := s3manager.NewUploader(s.Sess)
 	for {
+		atomic.StoreInt64(&s.buffer.progress, time.Now().UnixNano())
+
 		// check if folder exists
 		exists, err := swissIO.DirExists(s.buffer.path)
 		if err != nil {
@@ -162,7 +297,11 @@ func (s *S3) uploader() {
 
 		if !exists {
 			// one second interval loop
-			time.Sleep(1 * time.Second)
+			select {
+			case <-s.buffer.done:
+				return
+			case <-time.After(1 * time.Second):
+			}
 			continue
 		}
 
@@ -183,6 +322,9 @@ func (s *S3) uploader() {
 		if err != nil {
 			panic(err)
 		}
+		pendingFiles := s3PendingFiles.WithLabelValues(s.BucketName)
+		pendingFiles.Set(float64(len(files)))
+		atomic.StoreInt64(&s.buffer.files, int64(len(files)))
 		for _, file := range files {
 			// truncate buf.path (S3 path)
 			key := strings.Replace(file, s.buffer.path, "", 1)
@@ -208,8 +350,16 @@ func (s *S3) uploader() {
 				log.Errorln("Couldn't remove file: ", file)
 			}
 
+			pendingFiles.Dec()
+			atomic.AddInt64(&s.buffer.files, -1)
+			atomic.StoreInt64(&s.buffer.progress, time.Now().UnixNano())
+			s.health.wrote()
 			log.Info("Uploaded ", key)
 		}
-		time.Sleep(time.Duration(s.Config.UploadEvery) * time.Second)
+		select {
+		case <-s.buffer.done:
+			return
+		case <-time.After(time.Duration(s.Config.UploadEvery) * time.Second):
+		}
 	}
 }
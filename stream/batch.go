@@ -0,0 +1,120 @@
+package stream
+
+import (
+	"fmt"
+	"time"
+)
+
+// BatchDestination is implemented by destinations that can write
+// several messages at once, e.g. with a single Kinesis PutRecords
+// call. A pipeline writing to a BatchDestination groups messages
+// into batches if Pipeline.Batch is set.
+//
+// WriteBatch returns a *BatchError when only some of the messages
+// could not be written, any other error fails the whole batch.
+type BatchDestination interface {
+	WriteBatch(messages []Message) error
+}
+
+// BatchError reports which messages of a batch could not be
+// written. `Errors` has an entry per message, in batch order, that
+// is nil for messages that were written.
+type BatchError struct {
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	var failed int
+	var first error
+	for _, err := range e.Errors {
+		if err == nil {
+			continue
+		}
+		failed++
+		if first == nil {
+			first = err
+		}
+	}
+	return fmt.Sprintf("%d of %d messages failed: %v", failed, len(e.Errors), first)
+}
+
+// BatchPolicy decides when a batch is written: once it holds
+// `MaxCount` messages, once adding a message would make its payloads
+// exceed `MaxBytes`, or `MaxLinger` after its first message was
+// added, whichever comes first. 0 means no limit.
+//
+// Example:
+//  pipeline := stream.Pipeline{
+//      ...
+//      Batch: &stream.BatchPolicy{
+//          MaxCount:  500,
+//          MaxBytes:  5 << 20,
+//          MaxLinger: time.Second,
+//      },
+//  }
+type BatchPolicy struct {
+	MaxCount  int
+	MaxBytes  int
+	MaxLinger time.Duration
+}
+
+// DefaultBatchPolicy has the limits of Kinesis PutRecords, e.g.
+// Batch: &stream.DefaultBatchPolicy.
+var DefaultBatchPolicy = BatchPolicy{
+	MaxCount:  500,
+	MaxBytes:  5 << 20,
+	MaxLinger: 100 * time.Millisecond,
+}
+
+// entry is a transformed message waiting in a batch, along with the
+// message as it was read to dead-letter it.
+type entry struct {
+	message  Message
+	original Message
+}
+
+// batcher groups entries into batches according to its policy and
+// passes them to `write`.
+type batcher struct {
+	policy BatchPolicy
+	write  func(batch []entry)
+}
+
+// run batches entries read from `entries` until it is closed, then
+// writes the last batch.
+func (b *batcher) run(entries chan entry) {
+	var batch []entry
+	var size int
+	var linger <-chan time.Time
+
+	flush := func() {
+		if len(batch) > 0 {
+			b.write(batch)
+		}
+		batch, size, linger = nil, 0, nil
+	}
+
+	for {
+		select {
+		case e, ok := <-entries:
+			if !ok {
+				flush()
+				return
+			}
+			n := len(e.message.Payload)
+			if b.policy.MaxBytes > 0 && size+n > b.policy.MaxBytes {
+				flush()
+			}
+			batch = append(batch, e)
+			size += n
+			if len(batch) == 1 && b.policy.MaxLinger > 0 {
+				linger = time.After(b.policy.MaxLinger)
+			}
+			if b.policy.MaxCount > 0 && len(batch) >= b.policy.MaxCount {
+				flush()
+			}
+		case <-linger:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// batchDestination records the batches it writes. Messages whose
+// payload is in `fail` fail that many times.
+type batchDestination struct {
+	memoryDestination
+	batches [][]string
+	fail    map[string]int
+	errs    map[string]error
+}
+
+func (d *batchDestination) WriteBatch(messages []Message) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var batch []string
+	errs := make([]error, len(messages))
+	var failed bool
+	for i, m := range messages {
+		payload := string(m.Payload)
+		batch = append(batch, payload)
+		if err, ok := d.errs[payload]; ok {
+			errs[i], failed = err, true
+			continue
+		}
+		if d.fail[payload] > 0 {
+			d.fail[payload]--
+			errs[i], failed = errors.New("throttled"), true
+			continue
+		}
+		d.messages = append(d.messages, payload)
+	}
+	d.batches = append(d.batches, batch)
+
+	if failed {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
+
+func (d *batchDestination) written() [][]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([][]string(nil), d.batches...)
+}
+
+func runBatcher(policy BatchPolicy, payloads []string, wait time.Duration) [][]string {
+	var mu sync.Mutex
+	var batches [][]string
+	b := batcher{
+		policy: policy,
+		write: func(batch []entry) {
+			var payloads []string
+			for _, e := range batch {
+				payloads = append(payloads, string(e.message.Payload))
+			}
+			mu.Lock()
+			batches = append(batches, payloads)
+			mu.Unlock()
+		},
+	}
+
+	entries := make(chan entry)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.run(entries)
+	}()
+	for _, p := range payloads {
+		entries <- entry{message: NewMessage(p)}
+	}
+	time.Sleep(wait)
+
+	mu.Lock()
+	result := append([][]string(nil), batches...)
+	mu.Unlock()
+
+	close(entries)
+	<-done
+	return result
+}
+
+func TestBatcher_MaxCount(t *testing.T) {
+	batches := runBatcher(BatchPolicy{MaxCount: 2}, []string{"a", "b", "c", "d", "e"}, 0)
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d"}}, batches)
+}
+
+func TestBatcher_MaxBytes(t *testing.T) {
+	batches := runBatcher(BatchPolicy{MaxBytes: 4}, []string{"aa", "bb", "cc"}, 0)
+	assert.Equal(t, [][]string{{"aa", "bb"}}, batches)
+}
+
+func TestBatcher_MaxLinger(t *testing.T) {
+	batches := runBatcher(BatchPolicy{MaxCount: 10, MaxLinger: 20 * time.Millisecond}, []string{"a", "b"}, 50*time.Millisecond)
+	assert.Equal(t, [][]string{{"a", "b"}}, batches)
+}
+
+func TestPipeline_Batch(t *testing.T) {
+	src := &ackSource{sliceSource: sliceSource{messages: []string{"a", "b", "c", "d"}, close: true}}
+	dest := &batchDestination{fail: map[string]int{"B": 1}}
+	p := &Pipeline{
+		Source:      src,
+		Transformer: upperTransformer{},
+		Destination: dest,
+		Batch:       &BatchPolicy{MaxCount: 4},
+		Retry:       &RetryPolicy{MaxAttempts: 2},
+	}
+
+	assert.NoError(t, p.Run(context.Background()))
+
+	// only the failed message is retried
+	assert.Equal(t, [][]string{{"A", "B", "C", "D"}, {"B"}}, dest.written())
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d"}, src.acked)
+	assert.Empty(t, src.nacked)
+}
+
+func TestPipeline_BatchDisabled(t *testing.T) {
+	src := &sliceSource{messages: []string{"a", "b"}, close: true}
+	dest := &batchDestination{}
+	p := &Pipeline{Source: src, Destination: dest}
+
+	assert.NoError(t, p.Run(context.Background()))
+
+	// without Batch, messages are written one at a time
+	assert.Empty(t, dest.written())
+	assert.Equal(t, []string{"a", "b"}, dest.memoryDestination.written())
+}
+
+func TestPipeline_BatchPartialFailure(t *testing.T) {
+	src := &ackSource{sliceSource: sliceSource{messages: []string{"a", "b", "c"}, close: true}}
+	dest := &batchDestination{errs: map[string]error{
+		"b": Permanent(errors.New("invalid")),
+		"c": errors.New("unavailable"),
+	}}
+	dlq := &memoryDestination{}
+	p := &Pipeline{
+		Source:      src,
+		Destination: dest,
+		DeadLetter:  dlq,
+		Batch:       &BatchPolicy{MaxCount: 3},
+		Retry:       &RetryPolicy{MaxAttempts: 3},
+	}
+
+	assert.NoError(t, p.Run(context.Background()))
+
+	// "b" is not retried, "c" is until the policy gives up
+	assert.Equal(t, [][]string{{"a", "b", "c"}, {"c"}, {"c"}}, dest.written())
+	assert.Len(t, dlq.written(), 2)
+	for _, letter := range dlq.written() {
+		assert.True(t, strings.Contains(letter, `"stage":"write"`))
+	}
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, src.acked)
+}
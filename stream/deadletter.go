@@ -0,0 +1,56 @@
+package stream
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Stage is the pipeline stage a message failed at.
+type Stage string
+
+const (
+	StageTransform Stage = "transform"
+	StageWrite     Stage = "write"
+)
+
+// DeadLetter wraps a message that could not be transformed or
+// written, so that it can be inspected and replayed. It is written
+// to the dead-letter destination as JSON, the payload is base64
+// encoded so that binary payloads are kept intact.
+type DeadLetter struct {
+	Payload   []byte            `json:"payload"` // payload as read from the source
+	Key       string            `json:"key,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Error     string            `json:"error"`
+	Stage     Stage             `json:"stage"`
+	Attempts  int               `json:"attempts"`
+	Timestamp time.Time         `json:"timestamp"` // time of the failure
+}
+
+// NewDeadLetter wraps `message` which failed at `stage` with `err`
+// after `attempts` attempts.
+func NewDeadLetter(message Message, stage Stage, err error, attempts int) DeadLetter {
+	return DeadLetter{
+		Payload:   message.Payload,
+		Key:       message.Key,
+		Headers:   message.Headers,
+		Metadata:  message.Metadata,
+		Error:     err.Error(),
+		Stage:     stage,
+		Attempts:  attempts,
+		Timestamp: time.Now(),
+	}
+}
+
+// Message returns the dead letter as a message with a JSON payload
+// and the key and headers of the failed message.
+func (d DeadLetter) Message() Message {
+	payload, _ := json.Marshal(d)
+	return Message{
+		Payload:   payload,
+		Key:       d.Key,
+		Headers:   d.Headers,
+		Timestamp: d.Timestamp,
+	}
+}
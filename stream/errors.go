@@ -0,0 +1,77 @@
+package stream
+
+import "errors"
+
+// fatalError marks an error that must stop the pipeline.
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fatalError) Unwrap() error {
+	return e.err
+}
+
+// Fatal wraps err so that a pipeline receiving it from
+// `Destination.Write` stops and returns it instead of logging
+// it and moving on to the next message.
+//
+// Example:
+//  if !ok {
+//      return stream.Fatal(errors.New("streamName must be specified in Args."))
+//  }
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fatalError{err: err}
+}
+
+// IsFatal reports whether any error in err's chain was wrapped
+// with Fatal.
+func IsFatal(err error) bool {
+	var f *fatalError
+	return errors.As(err, &f)
+}
+
+// permanentError marks an error that retrying won't fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps err so that writes failing with it are not
+// retried, e.g. because the message is invalid. Transient errors,
+// such as throttling or a dropped connection, should be returned
+// as is.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether any error in err's chain was wrapped
+// with Permanent or Fatal.
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p) || IsFatal(err)
+}
+
+// errPipelineStopped is the cause of messages nacked because the
+// pipeline stopped before they could be written.
+var errPipelineStopped = errors.New("pipeline stopped")
+
+// ErrDrainTimeout is returned by a stopping pipeline when in-flight
+// messages could not be written before its drain deadline.
+var ErrDrainTimeout = errors.New("drain deadline exceeded")
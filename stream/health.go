@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"sync"
+	"time"
+)
+
+// Health is the state of a connector.
+type Health struct {
+	Connected bool       `json:"connected"`
+	LastRead  *time.Time `json:"lastRead,omitempty"`  // last message read
+	LastWrite *time.Time `json:"lastWrite,omitempty"` // last message written or uploaded
+	Backlog   int        `json:"backlog"`             // messages or files not delivered yet
+	// Error is the last error of the connector, until it connects or
+	// succeeds again. Errors of a connection that stays up, e.g. a
+	// failed request, leave Connected set.
+	Error string `json:"error,omitempty"`
+}
+
+// Healthy reports whether the connector is connected, transient
+// errors aside.
+func (h Health) Healthy() bool {
+	return h.Connected
+}
+
+// Ready reports whether the connector is connected and doesn't
+// report an error.
+func (h Health) Ready() bool {
+	return h.Connected && h.Error == ""
+}
+
+// HealthChecker is implemented by sources and destinations that
+// report their state. A pipeline is healthy as long as all of them
+// are connected, and ready while none reports an error either.
+type HealthChecker interface {
+	Health() Health
+}
+
+// healthState is embedded by connectors to keep track of their
+// health from several goroutines.
+type healthState struct {
+	mu     sync.Mutex
+	health Health
+}
+
+func (s *healthState) update(f func(h *Health)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.health)
+}
+
+func (s *healthState) get() Health {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.health
+}
+
+// connected records the outcome of a connection attempt.
+func (s *healthState) connected(err error) {
+	s.update(func(h *Health) {
+		h.Connected = err == nil
+		h.Error = ""
+		if err != nil {
+			h.Error = err.Error()
+		}
+	})
+}
+
+// errored records an error that leaves the connection up.
+func (s *healthState) errored(err error) {
+	s.update(func(h *Health) { h.Error = err.Error() })
+}
+
+func (s *healthState) disconnected() {
+	s.update(func(h *Health) { h.Connected = false })
+}
+
+func (s *healthState) read() {
+	now := time.Now()
+	s.update(func(h *Health) { h.LastRead = &now })
+}
+
+func (s *healthState) wrote() {
+	now := time.Now()
+	s.update(func(h *Health) { h.LastWrite = &now })
+}
@@ -0,0 +1,119 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// checkedDestination is a memoryDestination reporting `health`.
+type checkedDestination struct {
+	memoryDestination
+	health Health
+}
+
+func (d *checkedDestination) Health() Health {
+	return d.health
+}
+
+func probe(handler http.Handler) (int, healthReport) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	var report healthReport
+	json.NewDecoder(recorder.Body).Decode(&report)
+	return recorder.Code, report
+}
+
+func TestPipeline_HealthHandler(t *testing.T) {
+	dest := &checkedDestination{health: Health{Connected: true, Backlog: 3}}
+	p := &Pipeline{Source: &sliceSource{}, Destination: dest}
+
+	code, report := probe(p.HealthHandler())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", report.Status)
+	assert.Equal(t, 3, report.Checks["destination"].Backlog)
+	assert.NotContains(t, report.Checks, "source")
+
+	// errors of a connected destination only affect readiness
+	dest.health.Error = "request failed"
+	code, _ = probe(p.HealthHandler())
+	assert.Equal(t, http.StatusOK, code)
+
+	dest.health = Health{Error: "can't reconnect"}
+	code, report = probe(p.HealthHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", report.Status)
+}
+
+func TestPipeline_ReadyHandler(t *testing.T) {
+	dest := &checkedDestination{health: Health{Connected: true}}
+	p := &Pipeline{Source: &sliceSource{}, Destination: dest}
+
+	// not flowing yet
+	code, _ := probe(p.ReadyHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	p.flowing = 1
+	code, _ = probe(p.ReadyHandler())
+	assert.Equal(t, http.StatusOK, code)
+
+	dest.health.Error = "request failed"
+	code, _ = probe(p.ReadyHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	dest.health = Health{}
+	code, _ = probe(p.ReadyHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestWebSocket_Health(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(echo))
+	defer server.Close()
+
+	w := &WebSocket{URL: "ws" + strings.TrimPrefix(server.URL, "http")}
+	assert.NoError(t, w.Connect())
+	assert.NoError(t, w.Write("echo"))
+
+	h := w.Health()
+	assert.True(t, h.Connected)
+	assert.True(t, h.Healthy())
+	assert.NotNil(t, h.LastWrite)
+
+	w.Disconnect()
+	assert.False(t, w.Health().Connected)
+
+	w = &WebSocket{URL: "ws://127.0.0.1:1"}
+	assert.Error(t, w.Connect())
+	assert.False(t, w.Health().Healthy())
+}
+
+func TestHealthState(t *testing.T) {
+	var s healthState
+	s.connected(errors.New("refused"))
+	assert.Equal(t, Health{Error: "refused"}, s.get())
+
+	s.connected(nil)
+	s.read()
+	h := s.get()
+	assert.True(t, h.Connected)
+	assert.True(t, h.Ready())
+	assert.NotNil(t, h.LastRead)
+
+	s.errored(errors.New("timeout"))
+	h = s.get()
+	assert.True(t, h.Healthy())
+	assert.False(t, h.Ready())
+}
+
+func TestHealth_JSON(t *testing.T) {
+	// times are omitted until something is read or written
+	data, err := json.Marshal(Health{Connected: true})
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"connected":true,"backlog":0}`, string(data))
+	}
+}
@@ -0,0 +1,103 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// healthReport is the body of /healthz and /readyz responses.
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]Health `json:"checks"`
+}
+
+// HealthHandler returns a handler for liveness probes. It responds
+// with 503 Service Unavailable if a source or destination that is a
+// HealthChecker is disconnected, e.g. it can't reconnect, and 200 OK
+// otherwise. Errors of connectors that are still connected only fail
+// readiness.
+func (p *Pipeline) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks := p.checks()
+		healthy := true
+		for _, h := range checks {
+			healthy = healthy && h.Healthy()
+		}
+		p.report(w, healthy, checks)
+	})
+}
+
+// ReadyHandler returns a handler for readiness probes. It responds
+// with 200 OK while the pipeline is flowing data and all of its
+// HealthChecker sources and destinations are connected and don't
+// report an error, and 503 Service Unavailable otherwise.
+func (p *Pipeline) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks := p.checks()
+		ready := atomic.LoadInt32(&p.flowing) == 1
+		for _, h := range checks {
+			ready = ready && h.Ready()
+		}
+		p.report(w, ready, checks)
+	})
+}
+
+// checks returns the health of the source, destination and
+// dead-letter destination that are HealthCheckers.
+func (p *Pipeline) checks() map[string]Health {
+	checks := map[string]Health{}
+	components := map[string]interface{}{
+		"source":      p.Source,
+		"destination": p.Destination,
+		"deadLetter":  p.DeadLetter,
+	}
+	for name, c := range components {
+		if checker, ok := c.(HealthChecker); ok {
+			checks[name] = checker.Health()
+		}
+	}
+	return checks
+}
+
+func (p *Pipeline) report(w http.ResponseWriter, ok bool, checks map[string]Health) {
+	report := healthReport{Status: "ok", Checks: checks}
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		report.Status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// serveHTTP serves the /metrics, /healthz and /readyz endpoints on
+// HTTPAddr, if set, until the returned function is called.
+func (p *Pipeline) serveHTTP() (stop func()) {
+	if p.HTTPAddr == "" {
+		return func() {}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	mux.Handle("/healthz", p.HealthHandler())
+	mux.Handle("/readyz", p.ReadyHandler())
+	server := &http.Server{Addr: p.HTTPAddr, Handler: mux}
+
+	go func() {
+		log.Info("Serving metrics and health checks on ", p.HTTPAddr)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("HTTP server failed: ", err)
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}
+}
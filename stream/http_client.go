@@ -0,0 +1,296 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HTTP sends messages to URL, e.g. the ingestion endpoint of a REST
+// API.
+type HTTP struct {
+	URL     string
+	Method  string // POST if empty
+	Header  http.Header
+	Args    map[string]string
+	client  *http.Client
+	slots   chan struct{}   // limits concurrent requests
+	retry   map[int]bool    // status codes of failures worth retrying
+	forward map[string]bool // message headers sent with requests
+	health  healthState
+}
+
+// openHTTP returns an HTTP sending messages to a http://host/path
+// URI. Query parameters named like options become Args, the others
+// are kept in URL.
+func openHTTP(u *url.URL) (h *HTTP, err error) {
+	h = &HTTP{Args: map[string]string{}}
+	conn := *u
+	params := conn.Query()
+	for _, opt := range httpOptions {
+		if _, ok := params[opt.Name]; ok {
+			h.Args[opt.Name] = params.Get(opt.Name)
+			params.Del(opt.Name)
+		}
+	}
+	if _, ok := params["method"]; ok {
+		h.Method = strings.ToUpper(params.Get("method"))
+		params.Del("method")
+	}
+	conn.RawQuery = params.Encode()
+	h.URL = conn.String()
+	return
+}
+
+var httpOptions = Options{
+	{Name: "timeout", Type: DurationOption, Default: "30s", Description: "time limit of a request, including reading the response"},
+	{Name: "concurrency", Type: IntOption, Default: "8", Description: "maximum number of requests in flight, 0 for no limit"},
+	{Name: "contentType", Type: StringOption, Default: "application/json", Description: "Content-Type of single message requests"},
+	{Name: "batch", Type: BoolOption, Default: "false", Description: "send the messages of a pipeline batch in a single request, each in its own request otherwise"},
+	{Name: "batchFormat", Type: StringOption, Default: "json", Description: "body of batch requests: json for a JSON array, ndjson for a message per line"},
+	{Name: "forwardHeaders", Type: StringOption, Description: "comma separated message headers sent with requests, * for all, none if empty"},
+	{Name: "retryStatus", Type: StringOption, Description: "comma separated status codes to retry besides 408, 429 and 5xx, e.g. 409"},
+}
+
+// Options returns the Args HTTP accepts.
+func (h *HTTP) Options() Options {
+	return httpOptions
+}
+
+// Connect checks the configuration, the server is only contacted
+// once writing starts.
+func (h *HTTP) Connect() (err error) {
+	err = httpOptions.Validate(h.Args, DestinationOnly)
+	if err != nil {
+		return fmt.Errorf("HTTP: %w", err)
+	}
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return Permanent(fmt.Errorf("HTTP: URL must be an http or https URL, not %q", h.URL))
+	}
+	switch format := httpOptions.String(h.Args, "batchFormat"); format {
+	case "json", "ndjson":
+	default:
+		return Permanent(fmt.Errorf("HTTP: batchFormat must be json or ndjson, not %q", format))
+	}
+	h.retry = map[int]bool{http.StatusRequestTimeout: true, http.StatusTooManyRequests: true}
+	if codes := h.Args["retryStatus"]; codes != "" {
+		for _, code := range strings.Split(codes, ",") {
+			status, err := strconv.Atoi(strings.TrimSpace(code))
+			if err != nil {
+				return Permanent(fmt.Errorf("HTTP: retryStatus has an invalid status code %q", code))
+			}
+			h.retry[status] = true
+		}
+	}
+
+	h.forward = map[string]bool{}
+	if names := h.Args["forwardHeaders"]; names != "" {
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if name != "*" {
+				name = http.CanonicalHeaderKey(name)
+			}
+			h.forward[name] = true
+		}
+	}
+
+	h.client = &http.Client{Timeout: httpOptions.Duration(h.Args, "timeout")}
+	h.slots = nil
+	if n := httpOptions.Int(h.Args, "concurrency"); n > 0 {
+		h.slots = make(chan struct{}, n)
+	}
+	h.health.connected(nil)
+
+	return
+}
+
+func (h *HTTP) Disconnect() (err error) {
+	if h.client != nil {
+		h.client.CloseIdleConnections()
+	}
+	h.health.disconnected()
+	return
+}
+
+// Health reports whether requests succeed and when a message was last
+// sent.
+func (h *HTTP) Health() Health {
+	return h.health.get()
+}
+
+func (h *HTTP) Info() {
+	log.Info("URL: ", h.URL)
+	log.Info("Method: ", h.method())
+	log.Info("Args: ", h.Args)
+}
+
+func (h *HTTP) Write(message string) (err error) {
+	return h.WriteMessage(NewMessage(message))
+}
+
+// WriteMessage sends `message` as the body of a request, with Header
+// and the headers of `message` named in `forwardHeaders`. Header wins
+// over message headers, so that credentials can't be overridden.
+//
+// Requests that fail with a 408, 429 or 5xx status code, or one in
+// `retryStatus`, or that don't get a response, are worth retrying.
+// Other status codes outside 2xx make permanent errors.
+func (h *HTTP) WriteMessage(message Message) (err error) {
+	return h.send(message.Payload, httpOptions.String(h.Args, "contentType"), message.Headers)
+}
+
+// WriteBatch sends each of `messages` like WriteMessage, concurrently
+// within the `concurrency` limit, and reports the messages that
+// failed in a *BatchError.
+//
+// With `batch` set, `messages` are sent in a single request instead,
+// whose body is a JSON array of the payloads or, with `batchFormat`
+// set to ndjson, a payload per line. Payloads that aren't valid JSON
+// are added to arrays as strings. Only the forwarded headers that all
+// messages share are sent, and the batch succeeds or fails as a whole.
+func (h *HTTP) WriteBatch(messages []Message) (err error) {
+	if !httpOptions.Bool(h.Args, "batch") {
+		return h.writeEach(messages)
+	}
+
+	var body bytes.Buffer
+	contentType := "application/x-ndjson"
+	if httpOptions.String(h.Args, "batchFormat") == "json" {
+		contentType = "application/json"
+		items := make([]json.RawMessage, len(messages))
+		for i, message := range messages {
+			items[i] = message.Payload
+			if !json.Valid(message.Payload) {
+				items[i], _ = json.Marshal(string(message.Payload))
+			}
+		}
+		err = json.NewEncoder(&body).Encode(items)
+		if err != nil {
+			return Permanent(err)
+		}
+	} else {
+		for _, message := range messages {
+			body.Write(message.Payload)
+			body.WriteByte('\n')
+		}
+	}
+
+	return h.send(body.Bytes(), contentType, sharedHeaders(messages))
+}
+
+func (h *HTTP) writeEach(messages []Message) (err error) {
+	errs := make([]error, len(messages))
+	var wg sync.WaitGroup
+	for i := range messages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = h.WriteMessage(messages[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{Errors: errs}
+		}
+	}
+	return nil
+}
+
+// sharedHeaders returns the headers that all `messages` have with
+// the same value.
+func sharedHeaders(messages []Message) map[string]string {
+	if len(messages) == 0 {
+		return nil
+	}
+	shared := map[string]string{}
+	for name, value := range messages[0].Headers {
+		shared[name] = value
+	}
+	for _, message := range messages[1:] {
+		for name, value := range shared {
+			if v, ok := message.Headers[name]; !ok || v != value {
+				delete(shared, name)
+			}
+		}
+	}
+	return shared
+}
+
+func (h *HTTP) send(body []byte, contentType string, headers map[string]string) (err error) {
+	if h.slots != nil {
+		h.slots <- struct{}{}
+		defer func() { <-h.slots }()
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), h.method(), h.URL, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(fmt.Errorf("HTTP: %w", err))
+	}
+	for name, values := range h.Header {
+		req.Header[name] = values
+	}
+	for name, value := range headers {
+		name = http.CanonicalHeaderKey(name)
+		if (h.forward["*"] || h.forward[name]) && req.Header.Get(name) == "" {
+			req.Header.Set(name, value)
+		}
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		log.Error("HTTP: Request failed: ", err)
+		h.health.errored(err)
+		return
+	}
+	defer resp.Body.Close()
+	// read a bit of the body for the error, and the rest so that the
+	// connection can be reused
+	snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	io.Copy(ioutil.Discard, resp.Body)
+	h.health.connected(nil)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		h.health.wrote()
+		return
+	}
+	err = &HTTPError{StatusCode: resp.StatusCode, Body: string(snippet)}
+	log.Error("HTTP: ", err)
+	if resp.StatusCode >= 500 || h.retry[resp.StatusCode] {
+		return
+	}
+	return Permanent(err)
+}
+
+func (h *HTTP) method() string {
+	if h.Method == "" {
+		return http.MethodPost
+	}
+	return h.Method
+}
+
+// HTTPError is returned when the server responds with a status code
+// outside 2xx.
+type HTTPError struct {
+	StatusCode int
+	Body       string // start of the response body
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), strings.TrimSpace(e.Body))
+}
@@ -0,0 +1,155 @@
+package stream
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTP_WriteMessageAndBatch(t *testing.T) {
+	var requests []*http.Request
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+	}))
+	defer server.Close()
+
+	h := &HTTP{
+		URL:    server.URL + "/ingest",
+		Method: http.MethodPut,
+		Header: http.Header{"Authorization": {"Bearer t"}},
+		Args:   map[string]string{"batch": "true", "forwardHeaders": "x-id, Authorization"},
+	}
+	if !assert.NoError(t, h.Connect()) {
+		return
+	}
+	headers := map[string]string{"X-Id": "1", "Authorization": "Bearer caller", "X-Signature": "s"}
+	assert.NoError(t, h.WriteMessage(Message{Payload: []byte(`{"a":1}`), Headers: headers}))
+	assert.NoError(t, h.WriteBatch([]Message{{Payload: []byte(`{"a":1}`), Headers: headers}, {Payload: []byte("text"), Headers: map[string]string{"X-Id": "2"}}}))
+
+	h.Args = map[string]string{"batch": "true", "batchFormat": "ndjson"}
+	if !assert.NoError(t, h.Connect()) {
+		return
+	}
+	assert.NoError(t, h.WriteBatch([]Message{{Payload: []byte(`{"a":1}`)}, {Payload: []byte(`{"a":2}`)}}))
+
+	if assert.Len(t, requests, 3) {
+		assert.Equal(t, http.MethodPut, requests[0].Method)
+		assert.Equal(t, "/ingest", requests[0].URL.Path)
+		// Header wins over message headers, which are only forwarded
+		// if listed
+		assert.Equal(t, "Bearer t", requests[0].Header.Get("Authorization"))
+		assert.Equal(t, "1", requests[0].Header.Get("X-Id"))
+		assert.Empty(t, requests[0].Header.Get("X-Signature"))
+		assert.Equal(t, `{"a":1}`, bodies[0])
+		// X-Id differs between the messages of the batch
+		assert.Empty(t, requests[1].Header.Get("X-Id"))
+		assert.Equal(t, "[{\"a\":1},\"text\"]\n", bodies[1])
+		assert.Equal(t, "application/x-ndjson", requests[2].Header.Get("Content-Type"))
+		assert.Equal(t, "{\"a\":1}\n{\"a\":2}\n", bodies[2])
+	}
+}
+
+func TestHTTP_WriteBatchEach(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	h := &HTTP{URL: server.URL}
+	if !assert.NoError(t, h.Connect()) {
+		return
+	}
+	err := h.WriteBatch([]Message{NewMessage("a"), NewMessage("bad"), NewMessage("c")})
+
+	// without `batch`, each message is sent in its own request
+	var batchErr *BatchError
+	if assert.True(t, errors.As(err, &batchErr)) {
+		assert.NoError(t, batchErr.Errors[0])
+		assert.True(t, IsPermanent(batchErr.Errors[1]))
+		assert.NoError(t, batchErr.Errors[2])
+	}
+	assert.ElementsMatch(t, []string{"a", "c"}, bodies)
+}
+
+func TestHTTP_StatusClassification(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		status := map[string]int{"400": 400, "409": 409, "429": 429, "503": 503}[string(body)]
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	h := &HTTP{URL: server.URL, Args: map[string]string{"retryStatus": "409"}}
+	if !assert.NoError(t, h.Connect()) {
+		return
+	}
+	for body, permanent := range map[string]bool{"400": true, "409": false, "429": false, "503": false} {
+		err := h.Write(body)
+		var httpErr *HTTPError
+		if assert.True(t, errors.As(err, &httpErr), body) {
+			assert.Equal(t, body, httpErr.Error()[:3])
+			assert.Equal(t, permanent, IsPermanent(err), body)
+		}
+	}
+}
+
+func TestHTTP_ConcurrencyLimit(t *testing.T) {
+	var inFlight, max int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	h := &HTTP{URL: server.URL, Args: map[string]string{"concurrency": "2"}}
+	if !assert.NoError(t, h.Connect()) {
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, h.Write("{}"))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&max))
+}
+
+func TestOpenHTTP(t *testing.T) {
+	u, _ := url.Parse("https://api.example.com/v1/events?token=abc&timeout=5s&method=put")
+	h, err := openHTTP(u)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://api.example.com/v1/events?token=abc", h.URL)
+		assert.Equal(t, http.MethodPut, h.Method)
+		assert.Equal(t, map[string]string{"timeout": "5s"}, h.Args)
+	}
+}
@@ -0,0 +1,404 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HTTPServer receives messages posted to Path on Addr, e.g. webhooks
+// pushed by other services.
+type HTTPServer struct {
+	Addr     string // address to listen on, e.g. ":8080"
+	Path     string // "/" if empty
+	Args     map[string]string
+	server   *http.Server
+	listener net.Listener
+	channel  chan Message
+	mu       sync.Mutex // guards stopped
+	stopped  bool
+	handlers sync.WaitGroup // requests pushing messages
+	health   healthState
+}
+
+// openHTTPServer returns an HTTPServer listening on the host and
+// path of a http://0.0.0.0:8080/webhook URI, whose query parameters
+// set its Args.
+func openHTTPServer(u *url.URL) (s *HTTPServer, err error) {
+	s = &HTTPServer{Addr: u.Host, Path: u.Path}
+	s.Args, err = setFields(s, query(u))
+	return
+}
+
+var httpServerOptions = Options{
+	{Name: "maxBodySize", Type: IntOption, Default: "1048576", Description: "largest body accepted, in bytes"},
+	{Name: "ndjson", Type: BoolOption, Default: "false", Description: "split all bodies into lines, not only application/x-ndjson ones"},
+	{Name: "hmacHeader", Type: StringOption, Description: "header holding the HMAC signature of bodies, e.g. X-Hub-Signature-256, not checked if empty"},
+	{Name: "hmacSecret", Type: StringOption, Description: "secret bodies are signed with"},
+	{Name: "hmacAlgorithm", Type: StringOption, Default: "sha256", Description: "sha1, sha256 or sha512"},
+	{Name: "hmacEncoding", Type: StringOption, Default: "hex", Description: "encoding of signatures: hex or base64"},
+	{Name: "hmacPrefix", Type: StringOption, Description: "prefix of signatures, e.g. sha256="},
+	{Name: "queueTimeout", Type: DurationOption, Default: "1s", Description: "how long a request waits for the pipeline to take its first message before getting a 503"},
+	{Name: "retryAfter", Type: DurationOption, Default: "5s", Description: "Retry-After sent with 503 responses"},
+	{Name: "acknowledge", Type: BoolOption, Default: "false", Description: "respond once messages are written to the destination rather than read"},
+	{Name: "certFile", Type: StringOption, Description: "certificate to serve HTTPS with"},
+	{Name: "keyFile", Type: StringOption, Description: "private key of certFile"},
+}
+
+// Options returns the Args HTTPServer accepts.
+func (s *HTTPServer) Options() Options {
+	return httpServerOptions
+}
+
+// Connect starts listening. Requests get a 503 until messages are
+// read.
+func (s *HTTPServer) Connect() (err error) {
+	err = httpServerOptions.Validate(s.Args, SourceOnly)
+	if err != nil {
+		return fmt.Errorf("HTTPServer: %w", err)
+	}
+	if _, err = s.hash(); err != nil {
+		return Permanent(fmt.Errorf("HTTPServer: %w", err))
+	}
+	switch encoding := httpServerOptions.String(s.Args, "hmacEncoding"); encoding {
+	case "hex", "base64":
+	default:
+		return Permanent(fmt.Errorf("HTTPServer: hmacEncoding must be hex or base64, not %q", encoding))
+	}
+	if s.Args["hmacHeader"] != "" && s.Args["hmacSecret"] == "" {
+		return Permanent(errors.New("HTTPServer: hmacSecret must be specified with hmacHeader"))
+	}
+	certFile, keyFile := s.Args["certFile"], s.Args["keyFile"]
+	if (certFile == "") != (keyFile == "") {
+		return Permanent(errors.New("HTTPServer: certFile and keyFile must be specified together"))
+	}
+
+	path := s.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, s.handle)
+	s.server = &http.Server{Handler: mux}
+	s.channel = make(chan Message)
+	s.stopped = false
+
+	s.listener, err = net.Listen("tcp", s.Addr)
+	if err != nil {
+		log.Error("HTTPServer: Failed to listen: ", err)
+		s.health.connected(err)
+		return
+	}
+	log.Infof("HTTPServer: Listening on %s%s", s.listener.Addr(), path)
+	go func(server *http.Server, listener net.Listener) {
+		var err error
+		if certFile != "" {
+			err = server.ServeTLS(listener, certFile, keyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("HTTPServer: ", err)
+			s.health.connected(err)
+		}
+	}(s.server, s.listener)
+	s.health.connected(nil)
+
+	return
+}
+
+// Stop makes new requests get a 503 and closes the channel returned
+// by Read once the messages of requests being handled are pushed.
+func (s *HTTPServer) Stop() (err error) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	s.mu.Unlock()
+
+	s.handlers.Wait()
+	close(s.channel)
+	return
+}
+
+// Disconnect stops the server, waiting up to 5 seconds for requests
+// being handled to complete.
+func (s *HTTPServer) Disconnect() (err error) {
+	if s.server == nil {
+		log.Warn("HTTPServer.Disconnect(): server is nil")
+		return
+	}
+
+	s.Stop()
+
+	log.Info("Stopping HTTP server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.server.Shutdown(ctx)
+	if err != nil {
+		log.Warn("HTTPServer: Closing requests still being handled: ", err)
+		err = s.server.Close()
+	}
+	s.server = nil
+	s.health.disconnected()
+	log.Info("HTTP server stopped.")
+
+	return
+}
+
+// ListenAddr returns the address the server listens on, which has
+// the actual port if Addr has port 0.
+func (s *HTTPServer) ListenAddr() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Health reports whether the server is listening and when a message
+// was last received.
+func (s *HTTPServer) Health() Health {
+	return s.health.get()
+}
+
+func (s *HTTPServer) Info() {
+	log.Info("Addr: ", s.Addr)
+	log.Info("Path: ", s.Path)
+	log.Info("Args: ", s.Args)
+}
+
+func (s *HTTPServer) Read() (channel chan string, err error) {
+	messages, err := s.ReadMessages()
+	if err != nil {
+		return
+	}
+	return payloads(messages), nil
+}
+
+// ReadMessages is like Read but keeps the request headers of each
+// message, and its path and remote address in Metadata.
+//
+// A POST request carries a single message, or one per line if it is
+// application/x-ndjson or `ndjson` is set. It gets a 202 Accepted once
+// its messages are pushed into the channel, or with `acknowledge`, a
+// 200 OK once they are acked and a 500 if one is nacked. It gets a
+// 503 with a Retry-After header if the pipeline doesn't take its
+// first message within `queueTimeout`. Once the first message is
+// taken, the others are pushed too, even if the client goes away, so
+// that a body is never read partially and sent again by a retry. An
+// NDJSON body without any line gets a 400.
+func (s *HTTPServer) ReadMessages() (channel chan Message, err error) {
+	if s.channel == nil {
+		return nil, Fatal(errors.New("HTTPServer: not connected"))
+	}
+	return s.channel, nil
+}
+
+func (s *HTTPServer) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	maxBodySize := int64(httpServerOptions.Int(s.Args, "maxBodySize"))
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		if int64(len(body)) >= maxBodySize {
+			http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+		}
+		return
+	}
+	if !s.verify(r.Header, body) {
+		log.Warn("HTTPServer: Invalid signature from ", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var bodies [][]byte
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if httpServerOptions.Bool(s.Args, "ndjson") || mediaType == "application/x-ndjson" {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(nil, len(body)+1)
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				bodies = append(bodies, append([]byte(nil), line...))
+			}
+		}
+		if len(bodies) == 0 {
+			http.Error(w, "no messages in body", http.StatusBadRequest)
+			return
+		}
+	} else {
+		bodies = [][]byte{body}
+	}
+
+	acknowledge := httpServerOptions.Bool(s.Args, "acknowledge")
+	results := make(chan error, len(bodies))
+	messages := make([]Message, len(bodies))
+	for i, payload := range bodies {
+		messages[i] = s.message(r, payload)
+		if acknowledge {
+			messages[i] = messages[i].WithAcknowledger(resultAcker(results))
+		}
+	}
+	if !s.push(messages) {
+		s.unavailable(w)
+		return
+	}
+	if !acknowledge {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	for range bodies {
+		select {
+		case err := <-results:
+			if err != nil {
+				http.Error(w, "failed to write message", http.StatusInternalServerError)
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// push pushes `messages` into the channel, waiting up to
+// `queueTimeout` for the pipeline to take the first one. It returns
+// false, with none of them pushed, if the server is stopped or the
+// pipeline is saturated.
+//
+// The others are pushed whatever happens to the request, Stop waits
+// for them while the pipeline reads the channel until it is closed.
+func (s *HTTPServer) push(messages []Message) bool {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return false
+	}
+	s.handlers.Add(1)
+	s.mu.Unlock()
+	defer s.handlers.Done()
+
+	timer := time.NewTimer(httpServerOptions.Duration(s.Args, "queueTimeout"))
+	defer timer.Stop()
+	select {
+	case s.channel <- messages[0]:
+		s.health.read()
+	case <-timer.C:
+		log.Warn("HTTPServer: Pipeline is saturated, rejecting request")
+		return false
+	}
+
+	// the request is accepted, so the others must follow
+	for _, message := range messages[1:] {
+		s.channel <- message
+		s.health.read()
+	}
+	return true
+}
+
+func (s *HTTPServer) unavailable(w http.ResponseWriter) {
+	retryAfter := httpServerOptions.Duration(s.Args, "retryAfter")
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	http.Error(w, "pipeline is busy", http.StatusServiceUnavailable)
+}
+
+func (s *HTTPServer) message(r *http.Request, payload []byte) Message {
+	message := Message{
+		Payload:   payload,
+		Timestamp: time.Now(),
+		Headers:   map[string]string{},
+		Metadata: map[string]string{
+			"path":       r.URL.Path,
+			"remoteAddr": r.RemoteAddr,
+		},
+	}
+	for name := range r.Header {
+		message.Headers[name] = r.Header.Get(name)
+	}
+	return message
+}
+
+// resultAcker sends nil to `results` when acked, or the error a
+// message was nacked with.
+func resultAcker(results chan error) Acknowledger {
+	var once sync.Once
+	return ackFuncs{
+		ack: func() error {
+			once.Do(func() { results <- nil })
+			return nil
+		},
+		nack: func(err error) error {
+			if err == nil {
+				err = errors.New("nacked")
+			}
+			once.Do(func() { results <- err })
+			return nil
+		},
+	}
+}
+
+// verify checks the signature of `body` in the `hmacHeader` header,
+// if set.
+func (s *HTTPServer) verify(header http.Header, body []byte) bool {
+	name := s.Args["hmacHeader"]
+	if name == "" {
+		return true
+	}
+	signature := strings.TrimPrefix(header.Get(name), s.Args["hmacPrefix"])
+	var expected []byte
+	var err error
+	if httpServerOptions.String(s.Args, "hmacEncoding") == "base64" {
+		expected, err = base64.StdEncoding.DecodeString(signature)
+	} else {
+		expected, err = hex.DecodeString(signature)
+	}
+	if err != nil {
+		return false
+	}
+
+	newHash, _ := s.hash()
+	mac := hmac.New(newHash, []byte(s.Args["hmacSecret"]))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func (s *HTTPServer) hash() (func() hash.Hash, error) {
+	switch algorithm := httpServerOptions.String(s.Args, "hmacAlgorithm"); algorithm {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("hmacAlgorithm must be sha1, sha256 or sha512, not %q", algorithm)
+	}
+}
@@ -0,0 +1,145 @@
+package stream
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// post posts `body` to `s` in the background, the response is sent
+// to the returned channel.
+func post(s *HTTPServer, contentType, body string, header http.Header) chan *http.Response {
+	responses := make(chan *http.Response, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+s.ListenAddr()+"/hooks", strings.NewReader(body))
+		for name := range header {
+			req.Header.Set(name, header.Get(name))
+		}
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			close(responses)
+			return
+		}
+		resp.Body.Close()
+		responses <- resp
+	}()
+	return responses
+}
+
+func TestHTTPServer_NDJSONWithSignature(t *testing.T) {
+	s := &HTTPServer{Addr: "127.0.0.1:0", Path: "/hooks", Args: map[string]string{
+		"hmacHeader": "X-Hub-Signature-256",
+		"hmacSecret": "secret",
+		"hmacPrefix": "sha256=",
+	}}
+	if !assert.NoError(t, s.Connect()) {
+		return
+	}
+	defer s.Disconnect()
+	channel, err := s.ReadMessages()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	body := "{\"id\":1}\n{\"id\":2}\n"
+	resp := <-post(s, "application/x-ndjson", body, http.Header{"X-Hub-Signature-256": {"sha256=00"}})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	sign := func(body string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	responses := post(s, "application/x-ndjson", body, http.Header{
+		"X-Hub-Signature-256": {sign(body)},
+		"X-Event":             {"push"},
+	})
+	first, second := receive(t, channel), receive(t, channel)
+	assert.Equal(t, `{"id":1}`, first.String())
+	assert.Equal(t, `{"id":2}`, second.String())
+	assert.Equal(t, "push", first.Headers["X-Event"])
+	assert.Equal(t, "/hooks", first.Metadata["path"])
+	assert.Equal(t, http.StatusAccepted, (<-responses).StatusCode)
+
+	// stopping closes the channel and rejects requests
+	assert.NoError(t, s.Stop())
+	_, ok := <-channel
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, (<-post(s, "text/plain", "late", http.Header{"X-Hub-Signature-256": {sign("late")}})).StatusCode)
+}
+
+func TestHTTPServer_Backpressure(t *testing.T) {
+	s := &HTTPServer{Addr: "127.0.0.1:0", Path: "/hooks", Args: map[string]string{"queueTimeout": "50ms", "retryAfter": "3s"}}
+	if !assert.NoError(t, s.Connect()) {
+		return
+	}
+	defer s.Disconnect()
+
+	// nothing reads the messages
+	resp := <-post(s, "application/json", `{}`, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "3", resp.Header.Get("Retry-After"))
+}
+
+func TestHTTPServer_Acknowledge(t *testing.T) {
+	s := &HTTPServer{Addr: "127.0.0.1:0", Path: "/hooks", Args: map[string]string{"acknowledge": "true"}}
+	if !assert.NoError(t, s.Connect()) {
+		return
+	}
+	defer s.Disconnect()
+	channel, _ := s.ReadMessages()
+
+	responses := post(s, "application/json", `{"id":1}`, nil)
+	receive(t, channel).Nack(errors.New("failed"))
+	assert.Equal(t, http.StatusInternalServerError, (<-responses).StatusCode)
+
+	responses = post(s, "application/json", `{"id":1}`, nil)
+	receive(t, channel).Ack()
+	assert.Equal(t, http.StatusOK, (<-responses).StatusCode)
+}
+
+func TestHTTPServer_NDJSONNotSplit(t *testing.T) {
+	s := &HTTPServer{Addr: "127.0.0.1:0", Path: "/hooks", Args: map[string]string{"queueTimeout": "50ms"}}
+	if !assert.NoError(t, s.Connect()) {
+		return
+	}
+	defer s.Disconnect()
+	channel, _ := s.ReadMessages()
+
+	// the pipeline is slower than queueTimeout after the first message
+	responses := post(s, "application/x-ndjson", "{\"id\":1}\n{\"id\":2}\n{\"id\":3}\n", nil)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, receive(t, channel).String())
+		time.Sleep(150 * time.Millisecond)
+	}
+	assert.Equal(t, []string{`{"id":1}`, `{"id":2}`, `{"id":3}`}, ids)
+	assert.Equal(t, http.StatusAccepted, (<-responses).StatusCode)
+
+	select {
+	case message := <-channel:
+		t.Errorf("unexpected message %s", message.String())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHTTPServer_EmptyNDJSON(t *testing.T) {
+	s := &HTTPServer{Addr: "127.0.0.1:0", Path: "/hooks"}
+	if !assert.NoError(t, s.Connect()) {
+		return
+	}
+	defer s.Disconnect()
+	s.ReadMessages()
+
+	for _, body := range []string{"", "\n  \n"} {
+		assert.Equal(t, http.StatusBadRequest, (<-post(s, "application/x-ndjson", body, nil)).StatusCode)
+	}
+}
@@ -0,0 +1,556 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kafka reads a topic as a member of a consumer group, or produces
+// to a topic.
+type Kafka struct {
+	Brokers  []string
+	Topic    string
+	GroupID  string // consumer group, required to read
+	Args     map[string]string
+	config   *sarama.Config
+	group    sarama.ConsumerGroup
+	stop     context.CancelFunc // stops consuming, set by Read
+	mu       sync.Mutex         // guards producer
+	producer sarama.SyncProducer
+	backlog  int64         // messages read but not acked or nacked yet
+	done     chan struct{} // closed on Disconnect
+	health   healthState
+}
+
+// Overridden by tests to use in-process fakes instead of brokers.
+var (
+	newKafkaConsumerGroup = sarama.NewConsumerGroup
+	newKafkaProducer      = sarama.NewSyncProducer
+)
+
+// openKafka returns a Kafka for a kafka://broker1:9092,broker2:9092/topic
+// URI whose other query parameters, e.g. `groupId`, set its members
+// or Args.
+func openKafka(u *url.URL) (k *Kafka, err error) {
+	k = &Kafka{}
+	k.Args, err = setFields(k, query(u))
+	if err != nil {
+		return nil, err
+	}
+	if u.Host != "" {
+		k.Brokers = strings.Split(u.Host, ",")
+	}
+	k.Topic = strings.TrimPrefix(u.Path, "/")
+	return
+}
+
+var kafkaOptions = Options{
+	{Name: "version", Type: StringOption, Default: "2.1.0", Description: "Kafka version of the brokers, at least 0.11.0.0"},
+	{Name: "clientId", Type: StringOption, Default: "manifold", Description: "client ID sent to the brokers"},
+	{Name: "startOffset", Type: StringOption, Default: "newest", Usage: SourceOnly, Description: "where partitions without a committed offset are read from: oldest or newest"},
+	{Name: "commitEvery", Type: DurationOption, Default: "1s", Usage: SourceOnly, Description: "how often the offsets of acked messages are committed"},
+	{Name: "compression", Type: StringOption, Default: "none", Usage: DestinationOnly, Description: "none, gzip, snappy, lz4 or zstd"},
+	{Name: "idempotent", Type: BoolOption, Default: "true", Usage: DestinationOnly, Description: "let brokers discard duplicates of retried produce requests"},
+	{Name: "flushMessages", Type: IntOption, Usage: DestinationOnly, Description: "messages to wait for before sending a produce request"},
+	{Name: "flushFrequency", Type: DurationOption, Usage: DestinationOnly, Description: "time to wait for more messages before sending a produce request"},
+}
+
+// Options returns the Args Kafka accepts.
+func (k *Kafka) Options() Options {
+	return kafkaOptions
+}
+
+// Connect checks the configuration, brokers are only contacted once
+// reading or writing starts.
+func (k *Kafka) Connect() (err error) {
+	err = kafkaOptions.Validate(k.Args, SourceAndDestination)
+	if err != nil {
+		return fmt.Errorf("Kafka: %w", err)
+	}
+	if len(k.Brokers) == 0 || k.Topic == "" {
+		return Permanent(errors.New("Kafka: Brokers and Topic must be specified"))
+	}
+	k.config, err = k.newConfig()
+	if err != nil {
+		return fmt.Errorf("Kafka: %w", Permanent(err))
+	}
+
+	k.done = make(chan struct{})
+	k.health.connected(nil)
+
+	return
+}
+
+// newConfig returns the sarama configuration described by Args.
+func (k *Kafka) newConfig() (c *sarama.Config, err error) {
+	c = sarama.NewConfig()
+	c.ClientID = kafkaOptions.String(k.Args, "clientId")
+	c.Version, err = sarama.ParseKafkaVersion(kafkaOptions.String(k.Args, "version"))
+	if err != nil {
+		return
+	}
+
+	// consumer
+	switch offset := kafkaOptions.String(k.Args, "startOffset"); offset {
+	case "oldest":
+		c.Consumer.Offsets.Initial = sarama.OffsetOldest
+	case "newest":
+		c.Consumer.Offsets.Initial = sarama.OffsetNewest
+	default:
+		return nil, fmt.Errorf("startOffset must be oldest or newest, not %q", offset)
+	}
+	c.Consumer.Offsets.AutoCommit.Interval = kafkaOptions.Duration(k.Args, "commitEvery")
+	c.Consumer.Return.Errors = true
+
+	// producer
+	switch codec := kafkaOptions.String(k.Args, "compression"); codec {
+	case "none":
+		c.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		c.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		c.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		c.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		c.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, fmt.Errorf("unknown compression %q", codec)
+	}
+	c.Producer.RequiredAcks = sarama.WaitForAll
+	c.Producer.Return.Successes = true
+	if kafkaOptions.Bool(k.Args, "idempotent") {
+		c.Producer.Idempotent = true
+		c.Net.MaxOpenRequests = 1
+	}
+	c.Producer.Flush.Messages = kafkaOptions.Int(k.Args, "flushMessages")
+	c.Producer.Flush.Frequency = kafkaOptions.Duration(k.Args, "flushFrequency")
+
+	err = c.Validate()
+	return
+}
+
+// Stop stops consuming, which closes the channel returned by Read
+// once the messages read so far are acked or nacked, so that their
+// offsets are committed before the partitions are released.
+func (k *Kafka) Stop() (err error) {
+	if k.stop != nil {
+		log.Info("Kafka: Leaving consumer group...")
+		k.stop()
+		k.stop = nil
+	}
+	return
+}
+
+func (k *Kafka) Disconnect() (err error) {
+	k.Stop()
+	k.health.disconnected()
+	if k.done != nil {
+		close(k.done)
+		k.done = nil
+	}
+
+	if k.group != nil {
+		err = k.group.Close()
+		if err != nil {
+			log.Error("Kafka: Failed to close consumer group: ", err)
+		}
+		k.group = nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.producer != nil {
+		err = k.producer.Close()
+		if err != nil {
+			log.Error("Kafka: Failed to close producer: ", err)
+		}
+		k.producer = nil
+	}
+
+	return
+}
+
+// Health reports whether the consumer group or producer works, when
+// a message was last read or written, and how many messages were
+// read but not acked yet.
+func (k *Kafka) Health() Health {
+	h := k.health.get()
+	h.Backlog = int(atomic.LoadInt64(&k.backlog))
+	return h
+}
+
+func (k *Kafka) Info() {
+	log.Infof("Kafka.Brokers: %v", k.Brokers)
+	log.Infof("Kafka.Topic: %s", k.Topic)
+	log.Infof("Kafka.GroupID: %s", k.GroupID)
+	log.Infof("Kafka.Args: %+v", k.Args)
+}
+
+func (k *Kafka) Read() (channel chan string, err error) {
+	messages, err := k.ReadMessages()
+	if err != nil {
+		return
+	}
+	return payloads(messages), nil
+}
+
+// ReadMessages is like Read but keeps the key, headers, timestamp and
+// offset of each message, and its topic and partition in Metadata.
+//
+// The offset of a partition is committed, every `commitEvery`, past
+// the messages read from it that were all acked. A nacked message
+// can't be redelivered on its own, so the offset of its partition
+// stops advancing: it is read again, along with the messages after
+// it, once the partition is assigned anew, e.g. after a restart.
+func (k *Kafka) ReadMessages() (channel chan Message, err error) {
+	if k.GroupID == "" {
+		return nil, Fatal(errors.New("Kafka: GroupID must be specified to read"))
+	}
+
+	log.Info("Kafka: Joining consumer group ", k.GroupID)
+	group, err := newKafkaConsumerGroup(k.Brokers, k.GroupID, k.config)
+	if err != nil {
+		log.Error("Kafka: Failed to create consumer group: ", err)
+		k.health.connected(err)
+		return
+	}
+	k.group = group
+	go func() {
+		for err := range group.Errors() {
+			log.Error("Kafka: ", err)
+		}
+	}()
+
+	ctx, stop := context.WithCancel(context.Background())
+	k.stop = stop
+	channel = make(chan Message)
+	handler := &kafkaHandler{kafka: k, channel: channel, done: k.done}
+	go func() {
+		defer close(channel)
+		for ctx.Err() == nil {
+			// returns on rebalance, when claims must be made anew
+			err := group.Consume(ctx, []string{k.Topic}, handler)
+			if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				return
+			}
+			if err != nil {
+				log.Error("Kafka: Consume failed: ", err)
+				k.health.errored(err)
+				select {
+				case <-time.After(2 * time.Second):
+				case <-ctx.Done():
+				}
+			}
+		}
+	}()
+	return
+}
+
+// kafkaHandler pushes the messages of the partitions claimed by the
+// consumer group into `channel`.
+type kafkaHandler struct {
+	kafka   *Kafka
+	channel chan Message
+	done    chan struct{}
+}
+
+func (h *kafkaHandler) Setup(sess sarama.ConsumerGroupSession) error {
+	log.Infof("Kafka: Claimed partitions %v", sess.Claims())
+	h.kafka.health.connected(nil)
+	return nil
+}
+
+func (h *kafkaHandler) Cleanup(sess sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h *kafkaHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	offsets := &kafkaOffsets{
+		sess:      sess,
+		topic:     claim.Topic(),
+		partition: claim.Partition(),
+		acked:     map[int64]bool{},
+		resolved:  make(chan struct{}, 1),
+		backlog:   &h.kafka.backlog,
+	}
+	// give messages in flight a chance to be acked before the
+	// partition is released
+	defer offsets.wait(h.kafka.config.Consumer.Group.Rebalance.Timeout, h.done)
+
+	partition := strconv.Itoa(int(claim.Partition()))
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			h.kafka.health.read()
+			kafkaLag.WithLabelValues(msg.Topic, partition).Set(float64(claim.HighWaterMarkOffset() - msg.Offset - 1))
+			log.Trace(string(msg.Value))
+
+			message := kafkaMessage(msg).WithAcknowledger(offsets.acker(msg.Offset))
+			select {
+			case h.channel <- message:
+			case <-sess.Context().Done():
+				offsets.forget(msg.Offset)
+				return nil
+			case <-h.done:
+				offsets.forget(msg.Offset)
+				return nil
+			}
+		case <-sess.Context().Done():
+			return nil
+		}
+	}
+}
+
+// kafkaOffsets marks the offset of a claimed partition past the
+// messages read from it that were all acked, like checkpoint does
+// for Kinesis.
+type kafkaOffsets struct {
+	sess      sarama.ConsumerGroupSession
+	topic     string
+	partition int32
+	mu        sync.Mutex
+	pending   []int64        // offsets read, in order, not marked yet
+	acked     map[int64]bool // acked offsets in pending
+	frozen    bool
+	resolved  chan struct{} // signalled when a message is acked or nacked
+	backlog   *int64
+	unsettled int // messages neither acked nor nacked
+}
+
+// acker tracks the message at `offset`, which must be called in read
+// order.
+func (o *kafkaOffsets) acker(offset int64) Acknowledger {
+	o.mu.Lock()
+	o.pending = append(o.pending, offset)
+	o.unsettled++
+	o.mu.Unlock()
+	atomic.AddInt64(o.backlog, 1)
+
+	var once sync.Once
+	return ackFuncs{
+		ack: func() error {
+			once.Do(func() {
+				o.mu.Lock()
+				defer o.mu.Unlock()
+				o.acked[offset] = true
+				o.advance()
+				o.settle()
+			})
+			return nil
+		},
+		nack: func(err error) error {
+			once.Do(func() {
+				o.mu.Lock()
+				defer o.mu.Unlock()
+				if !o.frozen {
+					log.Warnf("Kafka: Message at offset %d of %s/%d was nacked, offsets won't be committed past it: %v", offset, o.topic, o.partition, err)
+				}
+				o.frozen = true
+				o.settle()
+			})
+			return nil
+		},
+	}
+}
+
+// advance marks the offset after the acked messages at the start of
+// pending.
+func (o *kafkaOffsets) advance() {
+	if o.frozen {
+		return
+	}
+	var n int
+	for n < len(o.pending) && o.acked[o.pending[n]] {
+		delete(o.acked, o.pending[n])
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	// the committed offset is the next one to read
+	o.sess.MarkOffset(o.topic, o.partition, o.pending[n-1]+1, "")
+	o.pending = o.pending[n:]
+}
+
+func (o *kafkaOffsets) settle() {
+	o.unsettled--
+	atomic.AddInt64(o.backlog, -1)
+	select {
+	case o.resolved <- struct{}{}:
+	default:
+	}
+}
+
+// forget stops tracking the message at `offset`, the last one read,
+// because it couldn't be pushed.
+func (o *kafkaOffsets) forget(offset int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending = o.pending[:len(o.pending)-1]
+	o.settle()
+}
+
+// wait waits until all messages are acked or nacked, `timeout`
+// passes or `done` is closed.
+func (o *kafkaOffsets) wait(timeout time.Duration, done chan struct{}) {
+	deadline := time.After(timeout)
+	for {
+		o.mu.Lock()
+		unsettled := o.unsettled
+		o.mu.Unlock()
+		if unsettled == 0 {
+			return
+		}
+
+		select {
+		case <-o.resolved:
+		case <-deadline:
+			log.Warnf("Kafka: Releasing %s/%d with %d messages in flight", o.topic, o.partition, unsettled)
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+func (k *Kafka) Write(message string) (err error) {
+	return k.WriteMessage(NewMessage(message))
+}
+
+// WriteMessage produces `message` to the topic, partitioned by its
+// key if set, and with its headers.
+func (k *Kafka) WriteMessage(message Message) (err error) {
+	producer, err := k.syncProducer()
+	if err != nil {
+		return
+	}
+
+	_, _, err = producer.SendMessage(k.producerMessage(message))
+	if err != nil {
+		log.Errorln("Kafka: SendMessage failed: ", err)
+		return kafkaError(err)
+	}
+	k.health.wrote()
+
+	return
+}
+
+// WriteBatch produces `messages` like WriteMessage, the producer
+// groups them into as few requests as possible. Messages the
+// brokers rejected are reported in a *BatchError.
+func (k *Kafka) WriteBatch(messages []Message) (err error) {
+	producer, err := k.syncProducer()
+	if err != nil {
+		return
+	}
+
+	msgs := make([]*sarama.ProducerMessage, len(messages))
+	for i, message := range messages {
+		msgs[i] = k.producerMessage(message)
+		msgs[i].Metadata = i
+	}
+
+	err = producer.SendMessages(msgs)
+	var failed sarama.ProducerErrors
+	if errors.As(err, &failed) {
+		log.Errorln("Kafka: SendMessages failed: ", err)
+		errs := make([]error, len(messages))
+		for _, e := range failed {
+			errs[e.Msg.Metadata.(int)] = kafkaError(e.Err)
+		}
+		if len(failed) < len(messages) {
+			k.health.wrote()
+		}
+		return &BatchError{Errors: errs}
+	}
+	if err != nil {
+		log.Errorln("Kafka: SendMessages failed: ", err)
+		return kafkaError(err)
+	}
+	k.health.wrote()
+
+	return
+}
+
+// syncProducer returns the producer, creating it on first use.
+func (k *Kafka) syncProducer() (sarama.SyncProducer, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.producer == nil {
+		producer, err := newKafkaProducer(k.Brokers, k.config)
+		if err != nil {
+			log.Error("Kafka: Failed to create producer: ", err)
+			k.health.connected(err)
+			return nil, err
+		}
+		k.producer = producer
+		k.health.connected(nil)
+	}
+	return k.producer, nil
+}
+
+func (k *Kafka) producerMessage(message Message) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic:     k.Topic,
+		Value:     sarama.ByteEncoder(message.Payload),
+		Timestamp: message.Timestamp,
+	}
+	if message.Key != "" {
+		msg.Key = sarama.StringEncoder(message.Key)
+	}
+	for name, value := range message.Headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(name), Value: []byte(value)})
+	}
+	return msg
+}
+
+// kafkaError marks errors that retrying can't fix, such as messages
+// that are too large or a missing authorization, as permanent.
+func kafkaError(err error) error {
+	var kerr sarama.KError
+	if errors.As(err, &kerr) {
+		switch kerr {
+		case sarama.ErrMessageSizeTooLarge, sarama.ErrInvalidTopic, sarama.ErrTopicAuthorizationFailed:
+			return Permanent(err)
+		}
+	}
+	return err
+}
+
+// kafkaMessage converts a consumed message into a message.
+func kafkaMessage(msg *sarama.ConsumerMessage) Message {
+	message := Message{
+		Payload:   msg.Value,
+		Key:       string(msg.Key),
+		Timestamp: msg.Timestamp,
+		Offset:    strconv.FormatInt(msg.Offset, 10),
+		Metadata: map[string]string{
+			"topic":     msg.Topic,
+			"partition": strconv.Itoa(int(msg.Partition)),
+		},
+	}
+	if len(msg.Headers) > 0 {
+		message.Headers = map[string]string{}
+		for _, header := range msg.Headers {
+			message.Headers[string(header.Key)] = string(header.Value)
+		}
+	}
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+	return message
+}
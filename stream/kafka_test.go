@@ -0,0 +1,210 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConsumerGroup hands `messages` to the handler as a single claim
+// of partition 0.
+type fakeConsumerGroup struct {
+	messages chan *sarama.ConsumerMessage
+	errors   chan error
+	sess     *fakeSession
+}
+
+func (g *fakeConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	g.sess.ctx = ctx
+	handler.Setup(g.sess)
+	err := handler.ConsumeClaim(g.sess, &fakeClaim{topic: topics[0], messages: g.messages})
+	handler.Cleanup(g.sess)
+	return err
+}
+
+func (g *fakeConsumerGroup) Errors() <-chan error {
+	return g.errors
+}
+
+func (g *fakeConsumerGroup) Close() error {
+	close(g.errors)
+	return nil
+}
+
+type fakeSession struct {
+	ctx    context.Context
+	mu     sync.Mutex
+	marked int64
+}
+
+func (s *fakeSession) Claims() map[string][]int32 { return nil }
+func (s *fakeSession) MemberID() string           { return "member" }
+func (s *fakeSession) GenerationID() int32        { return 1 }
+func (s *fakeSession) Commit()                    {}
+func (s *fakeSession) Context() context.Context   { return s.ctx }
+
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked = offset
+}
+
+func (s *fakeSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {}
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string)                 {}
+
+func (s *fakeSession) offset() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.marked
+}
+
+type fakeClaim struct {
+	topic    string
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *fakeClaim) Topic() string                            { return c.topic }
+func (c *fakeClaim) Partition() int32                         { return 0 }
+func (c *fakeClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return 10 }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// fakeProducer fails the messages whose payload is in `fail`.
+type fakeProducer struct {
+	fail map[string]error
+	sent []*sarama.ProducerMessage
+}
+
+func (p *fakeProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if err := p.fail[string(msg.Value.(sarama.ByteEncoder))]; err != nil {
+		return 0, 0, err
+	}
+	p.sent = append(p.sent, msg)
+	return 0, int64(len(p.sent)), nil
+}
+
+func (p *fakeProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	var errs sarama.ProducerErrors
+	for _, msg := range msgs {
+		if _, _, err := p.SendMessage(msg); err != nil {
+			errs = append(errs, &sarama.ProducerError{Msg: msg, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *fakeProducer) Close() error { return nil }
+
+func TestKafka_ReadMessagesCommitsAckedOffsets(t *testing.T) {
+	group := &fakeConsumerGroup{
+		messages: make(chan *sarama.ConsumerMessage, 3),
+		errors:   make(chan error),
+		sess:     &fakeSession{},
+	}
+	newKafkaConsumerGroup = func([]string, string, *sarama.Config) (sarama.ConsumerGroup, error) { return group, nil }
+	defer func() { newKafkaConsumerGroup = sarama.NewConsumerGroup }()
+
+	k := &Kafka{Brokers: []string{"localhost:9092"}, Topic: "events", GroupID: "g"}
+	if !assert.NoError(t, k.Connect()) {
+		return
+	}
+	channel, err := k.ReadMessages()
+	if !assert.NoError(t, err) {
+		return
+	}
+	for offset := int64(3); offset < 6; offset++ {
+		group.messages <- &sarama.ConsumerMessage{
+			Topic:   "events",
+			Offset:  offset,
+			Key:     []byte("k"),
+			Value:   []byte("v"),
+			Headers: []*sarama.RecordHeader{{Key: []byte("h"), Value: []byte("1")}},
+		}
+	}
+	a, b, c := <-channel, <-channel, <-channel
+
+	assert.Equal(t, "k", a.Key)
+	assert.Equal(t, "3", a.Offset)
+	assert.Equal(t, map[string]string{"h": "1"}, a.Headers)
+	assert.Equal(t, map[string]string{"topic": "events", "partition": "0"}, a.Metadata)
+	assert.Equal(t, 3, k.Health().Backlog)
+
+	b.Ack()
+	assert.Equal(t, int64(0), group.sess.offset())
+	a.Ack()
+	assert.Equal(t, int64(5), group.sess.offset())
+	c.Nack(errors.New("failed"))
+	assert.Equal(t, int64(5), group.sess.offset())
+	assert.Equal(t, 0, k.Health().Backlog)
+
+	// the channel is closed once consuming stops
+	k.Stop()
+	select {
+	case _, ok := <-channel:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Error("channel not closed")
+	}
+	assert.NoError(t, k.Disconnect())
+}
+
+func TestKafka_WriteBatch(t *testing.T) {
+	producer := &fakeProducer{fail: map[string]error{
+		"b": sarama.ErrMessageSizeTooLarge,
+		"c": sarama.ErrNotEnoughReplicas,
+	}}
+	newKafkaProducer = func([]string, *sarama.Config) (sarama.SyncProducer, error) { return producer, nil }
+	defer func() { newKafkaProducer = sarama.NewSyncProducer }()
+
+	k := &Kafka{Brokers: []string{"localhost:9092"}, Topic: "events", Args: map[string]string{"compression": "zstd"}}
+	if !assert.NoError(t, k.Connect()) {
+		return
+	}
+	err := k.WriteBatch([]Message{
+		{Payload: []byte("a"), Key: "k1", Headers: map[string]string{"h": "1"}},
+		{Payload: []byte("b")},
+		{Payload: []byte("c")},
+	})
+
+	var batchErr *BatchError
+	if assert.True(t, errors.As(err, &batchErr)) {
+		assert.NoError(t, batchErr.Errors[0])
+		assert.True(t, IsPermanent(batchErr.Errors[1]))
+		assert.False(t, IsPermanent(batchErr.Errors[2]))
+	}
+	if assert.Len(t, producer.sent, 1) {
+		assert.Equal(t, "events", producer.sent[0].Topic)
+		assert.Equal(t, sarama.StringEncoder("k1"), producer.sent[0].Key)
+		assert.Equal(t, []sarama.RecordHeader{{Key: []byte("h"), Value: []byte("1")}}, producer.sent[0].Headers)
+	}
+}
+
+func TestKafka_ConnectInvalidConfig(t *testing.T) {
+	k := &Kafka{Brokers: []string{"localhost:9092"}, Topic: "events", Args: map[string]string{"startOffset": "middle"}}
+	err := k.Connect()
+	assert.True(t, IsPermanent(err))
+
+	// zstd needs Kafka 2.1.0
+	k = &Kafka{Brokers: []string{"localhost:9092"}, Topic: "events", Args: map[string]string{"compression": "zstd", "version": "1.0.0"}}
+	assert.True(t, IsPermanent(k.Connect()))
+}
+
+func TestOpenKafka(t *testing.T) {
+	u, _ := url.Parse("kafka://b1:9092,b2:9092/events?groupId=g&startOffset=oldest")
+	k, err := openKafka(u)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"b1:9092", "b2:9092"}, k.Brokers)
+		assert.Equal(t, "events", k.Topic)
+		assert.Equal(t, "g", k.GroupID)
+		assert.Equal(t, map[string]string{"startOffset": "oldest"}, k.Args)
+	}
+}
@@ -0,0 +1,277 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MergeSource reads from several sources and merges their messages
+// into one channel. Each message is tagged with the name of the
+// source it came from in its `origin` metadata.
+//
+// A source that fails to connect, or whose channel is closed because
+// it failed, is reconnected in the background without affecting the
+// others. A source that closes its channel while it reports itself
+// connected and healthy (or doesn't report its health at all, such
+// as Stdio at EOF) has ended and is not reconnected; the merged
+// channel is closed once all sources have ended.
+//
+// Example:
+//  src := stream.MergeSource{
+//      Sources: map[string]stream.Source{
+//          "feed-a":  &stream.WebSocket{URL: "wss://a.example.com"},
+//          "queue-b": &stream.RabbitMQ{URL: url, Args: map[string]string{"queue": "b"}},
+//      },
+//  }
+type MergeSource struct {
+	Sources        map[string]Source
+	ReconnectDelay time.Duration // wait before reconnecting a child, defaults to 5 seconds
+	ctx            context.Context
+	cancel         context.CancelFunc
+	done           chan struct{} // closed on Disconnect
+	wg             sync.WaitGroup
+	mu             sync.Mutex
+	connected      map[string]bool
+}
+
+// Connect connects all sources. It fails only if none of them could
+// be connected, the others are retried once Read is called.
+func (m *MergeSource) Connect() (err error) {
+	if len(m.Sources) == 0 {
+		return errors.New("MergeSource: no sources")
+	}
+
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.done = make(chan struct{})
+	m.connected = map[string]bool{}
+	for _, name := range m.names() {
+		e := m.Sources[name].Connect()
+		if e != nil {
+			log.Errorf("MergeSource: %s: failed to connect: %v", name, e)
+			err = e
+			continue
+		}
+		m.connected[name] = true
+	}
+
+	if len(m.connected) > 0 {
+		return nil
+	}
+	return
+}
+
+// Stop stops all sources that can be stopped, the others are
+// disconnected.
+func (m *MergeSource) Stop() (err error) {
+	if m.cancel == nil {
+		return
+	}
+	m.cancel()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, src := range m.Sources {
+		if !m.connected[name] {
+			continue
+		}
+		if stopper, ok := src.(Stopper); ok {
+			err = stopper.Stop()
+		} else {
+			err = src.Disconnect()
+			m.connected[name] = false
+		}
+		if err != nil {
+			log.Errorf("MergeSource: %s: %v", name, err)
+		}
+	}
+	return
+}
+
+// Disconnect stops reading and disconnects all sources.
+func (m *MergeSource) Disconnect() (err error) {
+	if m.done == nil {
+		return
+	}
+	m.Stop()
+	close(m.done)
+	m.done = nil
+
+	m.mu.Lock()
+	for name, src := range m.Sources {
+		if !m.connected[name] {
+			continue
+		}
+		if e := src.Disconnect(); e != nil {
+			log.Errorf("MergeSource: %s: %v", name, e)
+			err = e
+		}
+		m.connected[name] = false
+	}
+	m.mu.Unlock()
+
+	m.wg.Wait()
+	return
+}
+
+func (m *MergeSource) Info() {
+	for _, name := range m.names() {
+		log.Infof("MergeSource source %s (%s)", name, reflect.TypeOf(m.Sources[name]))
+		m.Sources[name].Info()
+	}
+}
+
+func (m *MergeSource) Read() (channel chan string, err error) {
+	messages, err := m.ReadMessages()
+	if err != nil {
+		return
+	}
+	return payloads(messages), nil
+}
+
+// ReadMessages launches a goroutine per source that pushes its
+// messages into channel, reconnecting the source if needed. The
+// channel is closed after Stop once all sources are drained, or
+// once all sources have ended.
+func (m *MergeSource) ReadMessages() (channel chan Message, err error) {
+	channel = make(chan Message)
+	for _, name := range m.names() {
+		m.wg.Add(1)
+		go m.read(name, channel)
+	}
+
+	go func() {
+		m.wg.Wait()
+		close(channel)
+	}()
+	return
+}
+
+// read forwards messages from source `name` into channel until
+// MergeSource is stopped or the source has ended.
+func (m *MergeSource) read(name string, channel chan Message) {
+	defer m.wg.Done()
+	src := m.Sources[name]
+	ctx, done := m.ctx, m.done
+
+	for {
+		if !m.isConnected(name) {
+			err := src.Connect()
+			if err != nil {
+				log.Errorf("MergeSource: %s: failed to connect: %v", name, err)
+				if !m.wait(ctx) {
+					return
+				}
+				continue
+			}
+			m.setConnected(name, true)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		messages, err := AsMessageSource(src).ReadMessages()
+		if err != nil {
+			log.Errorf("MergeSource: %s: failed to read: %v", name, err)
+			m.reset(name)
+			if !m.wait(ctx) {
+				return
+			}
+			continue
+		}
+
+		for message := range messages {
+			if message.Metadata == nil {
+				message.Metadata = map[string]string{}
+			}
+			message.Metadata["origin"] = name
+
+			select {
+			case channel <- message:
+			case <-done:
+				return
+			}
+		}
+
+		// stopped, or the source closed its channel on its own
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		if !failed(src) {
+			log.Infof("MergeSource: %s: ended", name)
+			return
+		}
+		log.Warnf("MergeSource: %s: channel closed, reconnecting...", name)
+		m.reset(name)
+		if !m.wait(ctx) {
+			return
+		}
+	}
+}
+
+// failed reports whether `src` reports itself disconnected.
+func failed(src Source) bool {
+	hc, ok := src.(HealthChecker)
+	if !ok {
+		return false
+	}
+	return !hc.Health().Healthy()
+}
+
+// reset disconnects source `name` so that it is connected again,
+// unless Disconnect already did.
+func (m *MergeSource) reset(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.connected[name] {
+		return
+	}
+	m.Sources[name].Disconnect()
+	m.connected[name] = false
+}
+
+// wait waits for ReconnectDelay and reports whether MergeSource is
+// still running.
+func (m *MergeSource) wait(ctx context.Context) bool {
+	delay := m.ReconnectDelay
+	if delay == 0 {
+		delay = 5 * time.Second
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+func (m *MergeSource) isConnected(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.connected[name]
+}
+
+func (m *MergeSource) setConnected(name string, connected bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connected[name] = connected
+}
+
+// names returns the source names in a stable order.
+func (m *MergeSource) names() (names []string) {
+	for name := range m.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
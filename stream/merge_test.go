@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeSource_ReadMessages(t *testing.T) {
+	src := &MergeSource{
+		Sources: map[string]Source{
+			"a": &sliceSource{messages: []string{"a1", "a2"}},
+			"b": &sliceSource{messages: []string{"b1"}},
+		},
+	}
+	assert.NoError(t, src.Connect())
+
+	messages, err := src.ReadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		m := <-messages
+		assert.Equal(t, m.String()[:1], m.Metadata["origin"])
+		got = append(got, m.String())
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{"a1", "a2", "b1"}, got)
+
+	src.Stop()
+	_, open := <-messages
+	assert.False(t, open)
+	src.Disconnect()
+}
+
+// failingSource closes its channel after its messages were read and
+// reports itself disconnected.
+type failingSource struct {
+	sliceSource
+}
+
+func (s *failingSource) Health() Health {
+	return Health{Connected: false}
+}
+
+func TestMergeSource_ReconnectClosedChild(t *testing.T) {
+	// "a" fails after each read and is reconnected
+	src := &MergeSource{
+		Sources: map[string]Source{
+			"a": &failingSource{sliceSource{messages: []string{"a"}, close: true}},
+			"b": &sliceSource{messages: []string{"b"}},
+		},
+		ReconnectDelay: 10 * time.Millisecond,
+	}
+	assert.NoError(t, src.Connect())
+
+	messages, _ := src.ReadMessages()
+	count := map[string]int{}
+	for i := 0; i < 4; i++ {
+		count[(<-messages).String()]++
+	}
+	assert.Equal(t, 1, count["b"])
+	assert.Equal(t, 3, count["a"])
+
+	src.Disconnect()
+}
+
+func TestMergeSource_EndedChildren(t *testing.T) {
+	// both sources end, like Stdio at EOF
+	src := &MergeSource{
+		Sources: map[string]Source{
+			"a": &sliceSource{messages: []string{"a1", "a2"}, close: true},
+			"b": &sliceSource{messages: []string{"b1"}, close: true},
+		},
+		ReconnectDelay: 10 * time.Millisecond,
+	}
+	assert.NoError(t, src.Connect())
+
+	messages, _ := src.ReadMessages()
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case m, open := <-messages:
+			if !open {
+				done = true
+				break
+			}
+			got = append(got, m.String())
+		case <-timeout:
+			t.Fatal("merged channel not closed")
+		}
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{"a1", "a2", "b1"}, got)
+
+	assert.NoError(t, src.Disconnect())
+}
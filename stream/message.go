@@ -0,0 +1,238 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Message is the envelope of a piece of data flowing through the
+// pipeline. Besides the payload it carries what sources know about
+// it, so that destinations can make use of it.
+type Message struct {
+	Payload   []byte
+	Key       string            // partition or routing key
+	Headers   map[string]string // e.g. RabbitMQ headers
+	Timestamp time.Time         // time the message was produced or received
+	Offset    string            // position in the source, e.g. a sequence number
+	Metadata  map[string]string // source specific details
+	acker     Acknowledger
+}
+
+// Acknowledger is attached to messages by sources that need to know
+// whether a message was delivered, e.g. to commit an offset or to
+// redeliver it.
+type Acknowledger interface {
+	// Ack is called once the message has been written.
+	Ack() error
+	// Nack is called with the error that prevented the message
+	// from being written.
+	Nack(err error) error
+}
+
+// ackFuncs implements Acknowledger with functions.
+type ackFuncs struct {
+	ack  func() error
+	nack func(err error) error
+}
+
+func (a ackFuncs) Ack() error {
+	return a.ack()
+}
+
+func (a ackFuncs) Nack(err error) error {
+	return a.nack(err)
+}
+
+// NewMessage returns a message with `payload` received now.
+func NewMessage(payload string) Message {
+	return Message{
+		Payload:   []byte(payload),
+		Timestamp: time.Now(),
+	}
+}
+
+// WithAcknowledger returns a copy of the message that calls `a`
+// when it is acked or nacked.
+func (m Message) WithAcknowledger(a Acknowledger) Message {
+	m.acker = a
+	return m
+}
+
+// Ack tells the source that the message has been written. It is a
+// no-op for messages without an Acknowledger.
+func (m Message) Ack() error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.Ack()
+}
+
+// Nack tells the source that the message could not be written
+// because of `err`, so that it can be redelivered. It is a no-op
+// for messages without an Acknowledger.
+func (m Message) Nack(err error) error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.Nack(err)
+}
+
+// String returns the payload as a string.
+func (m Message) String() string {
+	return string(m.Payload)
+}
+
+// MessageSource is implemented by sources that read whole messages
+// instead of payload strings.
+type MessageSource interface {
+	Connect() error
+	Disconnect() error
+	Info()
+	ReadMessages() (chan Message, error)
+}
+
+// MessageDestination is implemented by destinations that make use
+// of message keys, headers or metadata.
+type MessageDestination interface {
+	Connect() error
+	Disconnect() error
+	Info()
+	WriteMessage(message Message) error
+}
+
+// ContextDestination is implemented by destinations whose writes
+// may wait, such as MultiDestination retries. The pipeline passes
+// the context that is cancelled when the drain deadline expires.
+type ContextDestination interface {
+	WriteMessageContext(ctx context.Context, message Message) error
+}
+
+// writeMessage writes `message` to `dest` with ctx if it is a
+// ContextDestination.
+func writeMessage(ctx context.Context, dest MessageDestination, message Message) error {
+	if cd, ok := dest.(ContextDestination); ok {
+		return cd.WriteMessageContext(ctx, message)
+	}
+	return dest.WriteMessage(message)
+}
+
+// DeferredAcker is implemented by destinations that buffer messages,
+// such as S3. They ack each message themselves once it is durably
+// persisted instead of the pipeline acking it when WriteMessage
+// returns.
+type DeferredAcker interface {
+	DefersAck() bool
+}
+
+// AsMessageSource returns `src` if it is a MessageSource, otherwise
+// it wraps `src` so that every string it reads becomes the payload
+// of a message.
+func AsMessageSource(src Source) MessageSource {
+	if ms, ok := src.(MessageSource); ok {
+		return ms
+	}
+	return &sourceAdapter{src}
+}
+
+// AsMessageDestination returns `dest` if it is a MessageDestination,
+// otherwise it wraps `dest` so that only message payloads are
+// written to it.
+func AsMessageDestination(dest Destination) MessageDestination {
+	if md, ok := dest.(MessageDestination); ok {
+		return md
+	}
+	return &destinationAdapter{dest}
+}
+
+type sourceAdapter struct {
+	Source
+}
+
+func (s *sourceAdapter) ReadMessages() (messages chan Message, err error) {
+	channel, err := s.Read()
+	if err != nil {
+		return
+	}
+
+	messages = make(chan Message)
+	go func() {
+		defer close(messages)
+		for payload := range channel {
+			messages <- NewMessage(payload)
+		}
+	}()
+	return
+}
+
+type destinationAdapter struct {
+	Destination
+}
+
+func (d *destinationAdapter) WriteMessage(message Message) error {
+	return d.Write(string(message.Payload))
+}
+
+// payloads converts a channel of messages into a channel of their
+// payloads. It is used by sources to implement Read on top of
+// ReadMessages.
+//
+// Strings can't be acknowledged, so messages are acked as soon as
+// they are pushed into the channel.
+func payloads(messages chan Message) (channel chan string) {
+	channel = make(chan string)
+	go func() {
+		defer close(channel)
+		for m := range messages {
+			channel <- string(m.Payload)
+			m.Ack()
+		}
+	}()
+	return
+}
+
+// joinAcker acks `message` once it has been acked `remaining` times,
+// e.g. by every destination a message was fanned out to, and nacks
+// it as soon as one of them nacks.
+type joinAcker struct {
+	mu        sync.Mutex
+	message   Message
+	remaining int
+	settled   bool
+}
+
+func newJoinAcker(message Message, n int) *joinAcker {
+	return &joinAcker{message: message, remaining: n}
+}
+
+func (j *joinAcker) Ack() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.settled {
+		return nil
+	}
+	j.remaining--
+	if j.remaining > 0 {
+		return nil
+	}
+	j.settled = true
+	return j.message.Ack()
+}
+
+func (j *joinAcker) Nack(err error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.settled {
+		return nil
+	}
+	j.settled = true
+	return j.message.Nack(err)
+}
+
+// settle ignores further acks and nacks, once the message was
+// acked or nacked by other means.
+func (j *joinAcker) settle() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.settled = true
+}
@@ -0,0 +1,36 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsMessageSource(t *testing.T) {
+	src := &sliceSource{messages: []string{"a", "b"}, close: true}
+	src.Connect()
+
+	messages, err := AsMessageSource(src).ReadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payloads []string
+	for m := range messages {
+		assert.False(t, m.Timestamp.IsZero())
+		payloads = append(payloads, m.String())
+	}
+	assert.Equal(t, []string{"a", "b"}, payloads)
+}
+
+func TestAsMessageDestination(t *testing.T) {
+	dest := &memoryDestination{}
+
+	err := AsMessageDestination(dest).WriteMessage(Message{
+		Payload: []byte("a"),
+		Key:     "key",
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, dest.written())
+}
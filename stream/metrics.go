@@ -0,0 +1,198 @@
+package stream
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, registered with the default registry.
+//
+// Pipeline metrics are labelled with the type of the pipeline's
+// source and destination, e.g. source="Kinesis",
+// destination="S3". Failures are also labelled with the stage they
+// happened at (transform or write) and the class of the error
+// (transient, permanent or fatal).
+var (
+	messagesRead = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "manifold",
+		Name:      "messages_read_total",
+		Help:      "Messages read from the source.",
+	}, []string{"source", "destination"})
+
+	messagesTransformed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "manifold",
+		Name:      "messages_transformed_total",
+		Help:      "Messages transformed successfully.",
+	}, []string{"source", "destination"})
+
+	messagesWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "manifold",
+		Name:      "messages_written_total",
+		Help:      "Messages written to the destination.",
+	}, []string{"source", "destination"})
+
+	messagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "manifold",
+		Name:      "messages_failed_total",
+		Help:      "Messages that could not be transformed or written.",
+	}, []string{"source", "destination", "stage", "class"})
+
+	messagesInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "manifold",
+		Name:      "messages_in_flight",
+		Help:      "Messages read but not yet written or failed.",
+	}, []string{"source", "destination"})
+
+	writeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "manifold",
+		Name:      "write_duration_seconds",
+		Help:      "Duration of destination writes, including batch writes.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"source", "destination"})
+
+	transformDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "manifold",
+		Name:      "transform_duration_seconds",
+		Help:      "Duration of message transformations.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"source", "destination"})
+
+	s3BufferBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "manifold",
+		Name:      "s3_buffer_bytes",
+		Help:      "Size of the S3 buffer file not yet committed.",
+	}, []string{"bucket"})
+
+	s3PendingFiles = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "manifold",
+		Name:      "s3_pending_files",
+		Help:      "Committed S3 buffer files waiting to be uploaded.",
+	}, []string{"bucket"})
+
+	websocketReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "manifold",
+		Name:      "websocket_reconnects_total",
+		Help:      "WebSocket connections established after the first one.",
+	})
+
+	webSocketClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "manifold",
+		Name:      "websocket_server_clients",
+		Help:      "Clients connected to WebSocket servers.",
+	})
+
+	webSocketDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "manifold",
+		Name:      "websocket_server_dropped_total",
+		Help:      "Messages WebSocket server clients missed because their buffer was full.",
+	})
+
+	mqttReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "manifold",
+		Name:      "mqtt_reconnects_total",
+		Help:      "MQTT connections established after the first one.",
+	})
+
+	mqttDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "manifold",
+		Name:      "mqtt_dropped_total",
+		Help:      "MQTT messages dropped because the queue of received messages was full.",
+	})
+
+	kinesisMillisBehind = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "manifold",
+		Name:      "kinesis_millis_behind_latest",
+		Help:      "Milliseconds the Kinesis consumer is behind the tip of the shard.",
+	}, []string{"shard"})
+
+	redisClaimed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "manifold",
+		Name:      "redis_claimed_total",
+		Help:      "Redis stream entries claimed after being pending for too long.",
+	})
+
+	kafkaLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "manifold",
+		Name:      "kafka_consumer_lag",
+		Help:      "Messages of a Kafka partition the consumer hasn't read yet.",
+	}, []string{"topic", "partition"})
+)
+
+// MetricsHandler returns a handler serving the metrics of all
+// pipelines in the Prometheus text format, to be mounted on an
+// existing HTTP server. See Pipeline.HTTPAddr to serve it on its own.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// pipelineMetrics holds the metrics of a pipeline, labelled with its
+// source and destination types.
+type pipelineMetrics struct {
+	source      string
+	destination string
+	read        prometheus.Counter
+	transformed prometheus.Counter
+	written     prometheus.Counter
+	inFlight    prometheus.Gauge
+	write       prometheus.Observer
+	transform   prometheus.Observer
+}
+
+func newPipelineMetrics(src Source, dest Destination) *pipelineMetrics {
+	labels := prometheus.Labels{
+		"source":      typeName(src),
+		"destination": typeName(dest),
+	}
+	return &pipelineMetrics{
+		source:      labels["source"],
+		destination: labels["destination"],
+		read:        messagesRead.With(labels),
+		transformed: messagesTransformed.With(labels),
+		written:     messagesWritten.With(labels),
+		inFlight:    messagesInFlight.With(labels),
+		write:       writeDuration.With(labels),
+		transform:   transformDuration.With(labels),
+	}
+}
+
+// failed counts `n` messages that failed at `stage` with `err`.
+func (m *pipelineMetrics) failed(stage Stage, err error, n int) {
+	messagesFailed.WithLabelValues(m.source, m.destination, string(stage), errorClass(err)).Add(float64(n))
+}
+
+// since observes the time elapsed since `start` in seconds.
+func since(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+// errorClass returns the class of `err` used as a metric label.
+func errorClass(err error) string {
+	switch {
+	case IsFatal(err):
+		return "fatal"
+	case IsPermanent(err):
+		return "permanent"
+	case errors.Is(err, errPipelineStopped):
+		return "stopped"
+	}
+	return "transient"
+}
+
+// typeName returns the name of the type of `v` without its package
+// or pointer, e.g. "Kinesis" for a *stream.Kinesis.
+func typeName(v interface{}) string {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return "none"
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
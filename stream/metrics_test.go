@@ -0,0 +1,44 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline_Metrics(t *testing.T) {
+	src := &sliceSource{messages: []string{"a", "bad", "c"}, close: true}
+	dest := &memoryDestination{}
+	p := &Pipeline{Source: src, Transformer: upperTransformer{}, Destination: dest}
+
+	read := messagesRead.WithLabelValues("sliceSource", "memoryDestination")
+	written := messagesWritten.WithLabelValues("sliceSource", "memoryDestination")
+	failed := messagesFailed.WithLabelValues("sliceSource", "memoryDestination", "transform", "transient")
+	inFlight := messagesInFlight.WithLabelValues("sliceSource", "memoryDestination")
+	before := []float64{testutil.ToFloat64(read), testutil.ToFloat64(written), testutil.ToFloat64(failed), testutil.ToFloat64(inFlight)}
+
+	assert.NoError(t, p.Run(context.Background()))
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(read)-before[0])
+	assert.Equal(t, 2.0, testutil.ToFloat64(written)-before[1])
+	assert.Equal(t, 1.0, testutil.ToFloat64(failed)-before[2])
+	assert.Equal(t, 0.0, testutil.ToFloat64(inFlight)-before[3])
+
+	recorder := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	assert.Contains(t, string(body), `manifold_messages_written_total{destination="memoryDestination",source="sliceSource"}`)
+	assert.Contains(t, string(body), "manifold_write_duration_seconds_bucket")
+}
+
+func TestErrorClass(t *testing.T) {
+	err := errors.New("boom")
+	assert.Equal(t, "transient", errorClass(err))
+	assert.Equal(t, "permanent", errorClass(Permanent(err)))
+	assert.Equal(t, "fatal", errorClass(Fatal(err)))
+}
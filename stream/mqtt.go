@@ -0,0 +1,441 @@
+package stream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// MQTT subscribes to a topic filter, which may have `+` and `#`
+// wildcards, or publishes on a topic of an MQTT broker.
+//
+// Like WebSocket it reconnects when the connection drops, and
+// subscribes again once reconnected.
+//
+// Example:
+//
+//   Args: map[string]string{
+//       "clientId":     "telemetry-bridge",
+//       "cleanSession": "false",
+//       "qos":          "1",
+//   }
+type MQTT struct {
+	URL       string // e.g. tcp://user:pw@host:1883 or ssl://host:8883
+	Topic     string
+	TLSConfig *tls.Config // overrides the caFile, certFile and keyFile args
+	Args      map[string]string
+	client    mqtt.Client
+	mu        sync.Mutex          // guards the fields below
+	handler   mqtt.MessageHandler // set by Read, to subscribe again on reconnect
+	stop      chan struct{}       // closed on Stop
+	queue     []Message           // received messages not pushed yet
+	connects  int                 // connections established
+	health    healthState
+}
+
+// openMQTT returns an MQTT for a URI like mqtt://host:1883/topic, or
+// mqtts:// for TLS, whose query parameters set its members or Args.
+func openMQTT(u *url.URL) (m *MQTT, err error) {
+	m = &MQTT{}
+	m.Args, err = setFields(m, query(u))
+	if err != nil {
+		return nil, err
+	}
+	if m.Topic == "" && len(u.Path) > 1 {
+		m.Topic = u.Path[1:]
+	}
+	broker := *u
+	broker.Scheme = "tcp"
+	if u.Scheme == "mqtts" {
+		broker.Scheme = "ssl"
+	}
+	broker.Path = ""
+	broker.RawQuery = ""
+	m.URL = broker.String()
+	return
+}
+
+var mqttOptions = Options{
+	{Name: "clientId", Type: StringOption, Description: "client identifier, generated if empty, required to resume a session"},
+	{Name: "qos", Type: IntOption, Default: "1", Description: "quality of service to subscribe and publish with: 0, 1 or 2"},
+	{Name: "cleanSession", Type: BoolOption, Default: "true", Description: "\"false\" makes the broker keep subscriptions and queue messages while disconnected"},
+	{Name: "keepAlive", Type: DurationOption, Default: "30s", Description: "interval of keep-alive pings"},
+	{Name: "maxReconnectInterval", Type: DurationOption, Default: "1m", Description: "maximum wait between reconnection attempts"},
+	{Name: "writeTimeout", Type: DurationOption, Default: "30s", Description: "time to wait for the broker to acknowledge a published message"},
+	{Name: "willTopic", Type: StringOption, Description: "topic the broker publishes the last will on if the connection is lost"},
+	{Name: "willPayload", Type: StringOption, Description: "payload of the last will"},
+	{Name: "willQos", Type: IntOption, Default: "0", Description: "quality of service of the last will"},
+	{Name: "willRetain", Type: BoolOption, Default: "false", Description: "retain the last will"},
+	{Name: "retain", Type: BoolOption, Default: "false", Usage: DestinationOnly, Description: "retain published messages"},
+	{Name: "queueSize", Type: IntOption, Default: "10000", Usage: SourceOnly, Description: "received messages queued while the pipeline is busy, more are dropped, 0 for no limit"},
+	{Name: "caFile", Type: StringOption, Description: "PEM file of the CAs to verify the broker with"},
+	{Name: "certFile", Type: StringOption, Description: "PEM file of the client certificate"},
+	{Name: "keyFile", Type: StringOption, Description: "PEM file of the client key"},
+}
+
+// Options returns the Args MQTT accepts.
+func (m *MQTT) Options() Options {
+	return mqttOptions
+}
+
+func (m *MQTT) Info() {
+	log.Info("URL: ", m.URL)
+	log.Info("Topic: ", m.Topic)
+	log.Info("Args: ", m.Args)
+}
+
+// Connect connects to the broker. Once connected, the client
+// reconnects on its own whenever the connection is lost.
+func (m *MQTT) Connect() (err error) {
+	err = mqttOptions.Validate(m.Args, SourceAndDestination)
+	if err != nil {
+		return fmt.Errorf("MQTT: %w", err)
+	}
+	if m.Topic == "" {
+		return Permanent(errors.New("MQTT: Topic must be specified"))
+	}
+	for _, name := range []string{"qos", "willQos"} {
+		if qos := mqttOptions.Int(m.Args, name); qos < 0 || qos > 2 {
+			return Permanent(fmt.Errorf("MQTT: %s must be 0, 1 or 2", name))
+		}
+	}
+
+	opts, err := m.clientOptions()
+	if err != nil {
+		return fmt.Errorf("MQTT: %w", Permanent(err))
+	}
+	m.client = mqtt.NewClient(opts)
+
+	log.Info("Establishing MQTT connection...")
+	token := m.client.Connect()
+	token.Wait()
+	err = token.Error()
+	if err != nil {
+		log.Error("MQTT: Failed to connect: ", err)
+	}
+	m.health.connected(err)
+
+	return
+}
+
+// clientOptions returns the client options described by Args.
+func (m *MQTT) clientOptions() (opts *mqtt.ClientOptions, err error) {
+	clientID := m.Args["clientId"]
+	if clientID == "" {
+		clientID = fmt.Sprintf("manifold-%d-%d", os.Getpid(), time.Now().UnixNano())
+	}
+
+	opts = mqtt.NewClientOptions().
+		AddBroker(m.URL).
+		SetClientID(clientID).
+		SetCleanSession(mqttOptions.Bool(m.Args, "cleanSession")).
+		SetKeepAlive(mqttOptions.Duration(m.Args, "keepAlive")).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(mqttOptions.Duration(m.Args, "maxReconnectInterval")).
+		SetAutoAckDisabled(true).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.Error("MQTT: Connection lost: ", err)
+			m.health.connected(err)
+		})
+
+	if topic := m.Args["willTopic"]; topic != "" {
+		opts.SetWill(topic, m.Args["willPayload"], byte(mqttOptions.Int(m.Args, "willQos")), mqttOptions.Bool(m.Args, "willRetain"))
+	}
+
+	tlsConfig := m.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig, err = mqttTLSConfig(m.Args)
+		if err != nil {
+			return
+		}
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return
+}
+
+// mqttTLSConfig returns the TLS configuration for the CA, certificate
+// and key files in `args`, or nil if none is set.
+func mqttTLSConfig(args map[string]string) (*tls.Config, error) {
+	if args["caFile"] == "" && args["certFile"] == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if path := args["caFile"]; path != "" {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", path)
+		}
+	}
+	if args["certFile"] != "" {
+		cert, err := tls.LoadX509KeyPair(args["certFile"], args["keyFile"])
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// onConnect is called on every connection, it subscribes again
+// after a reconnection since a clean session loses subscriptions.
+func (m *MQTT) onConnect(client mqtt.Client) {
+	m.mu.Lock()
+	m.connects++
+	reconnected := m.connects > 1
+	handler := m.handler
+	m.mu.Unlock()
+
+	m.health.connected(nil)
+	if !reconnected {
+		return
+	}
+	mqttReconnects.Inc()
+	log.Warn("MQTT: Reconnected.")
+
+	if handler != nil {
+		if err := m.subscribe(handler); err != nil {
+			log.Error("MQTT: Failed to subscribe again: ", err)
+			m.health.errored(err)
+		}
+	}
+}
+
+func (m *MQTT) subscribe(handler mqtt.MessageHandler) error {
+	token := m.client.Subscribe(m.Topic, byte(mqttOptions.Int(m.Args, "qos")), handler)
+	token.Wait()
+	return token.Error()
+}
+
+// Health reports whether the client is connected, when a message
+// was last received or published, and how many received messages
+// wait to be pushed into the channel.
+func (m *MQTT) Health() Health {
+	h := m.health.get()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h.Backlog = len(m.queue)
+	return h
+}
+
+// Stop unsubscribes, which closes the channel returned by Read.
+// Messages that weren't pushed into it are dropped without being
+// acked, so that a persistent session gets them again.
+func (m *MQTT) Stop() (err error) {
+	m.mu.Lock()
+	if m.handler == nil {
+		m.mu.Unlock()
+		return
+	}
+	m.handler = nil
+	close(m.stop)
+	m.queue = nil
+	m.mu.Unlock()
+
+	log.Info("Unsubscribing from MQTT topic...")
+	token := m.client.Unsubscribe(m.Topic)
+	token.Wait()
+	err = token.Error()
+	if err != nil {
+		log.Error("MQTT: Failed to unsubscribe: ", err)
+	}
+	return
+}
+
+func (m *MQTT) Disconnect() (err error) {
+	if m.client == nil {
+		log.Warn("MQTT.Disconnect(): client is nil")
+		return
+	}
+
+	m.Stop()
+	log.Info("Closing MQTT connection...")
+	m.client.Disconnect(250)
+	m.health.disconnected()
+	log.Info("MQTT connection closed.")
+
+	return
+}
+
+// Read subscribes to the topic filter with `qos`. Messages read with
+// Read are acked once pushed into the channel.
+func (m *MQTT) Read() (channel chan string, err error) {
+	messages, err := m.ReadMessages()
+	if err != nil {
+		return
+	}
+	return payloads(messages), nil
+}
+
+// ReadMessages is like Read but keeps the topic of each message as
+// its key, and its QoS and retained flag in Metadata.
+//
+// QoS 1 and 2 messages are acked to the broker when they are acked.
+// MQTT can't redeliver a nacked message right away: it is left
+// unacked, so that the broker sends it again when a persistent
+// session (`cleanSession` "false") reconnects.
+//
+// Received messages are queued until they are pushed into the
+// channel, so that a slow pipeline doesn't stall the client, which
+// would then miss keep-alive pings and lose its connection. Messages
+// received while `queueSize` messages are queued are dropped without
+// being acked.
+func (m *MQTT) ReadMessages() (channel chan Message, err error) {
+	channel = make(chan Message)
+	stop := make(chan struct{})
+	queued := make(chan struct{}, 1)
+	queueSize := mqttOptions.Int(m.Args, "queueSize")
+
+	handler := func(client mqtt.Client, msg mqtt.Message) {
+		m.health.read()
+		log.Trace(string(msg.Payload()))
+		message := mqttMessage(msg)
+		if msg.Qos() > 0 {
+			message = message.WithAcknowledger(mqttAcker(msg))
+		}
+
+		m.mu.Lock()
+		select {
+		case <-stop:
+			m.mu.Unlock()
+			return
+		default:
+		}
+		if queueSize > 0 && len(m.queue) >= queueSize {
+			m.mu.Unlock()
+			mqttDropped.Inc()
+			log.Warnf("MQTT: Queue full, dropping message from %s", msg.Topic())
+			return
+		}
+		m.queue = append(m.queue, message)
+		m.mu.Unlock()
+		select {
+		case queued <- struct{}{}:
+		default:
+		}
+	}
+
+	m.mu.Lock()
+	m.stop = stop
+	m.handler = handler
+	m.queue = nil
+	m.mu.Unlock()
+
+	err = m.subscribe(handler)
+	if err != nil {
+		log.Error("MQTT: Failed to subscribe: ", err)
+		m.mu.Lock()
+		m.handler = nil
+		m.mu.Unlock()
+		return nil, err
+	}
+
+	go func() {
+		defer close(channel)
+		for {
+			m.mu.Lock()
+			if len(m.queue) == 0 {
+				m.mu.Unlock()
+				select {
+				case <-queued:
+					continue
+				case <-stop:
+					return
+				}
+			}
+			// keep the message queued while it waits for the pipeline
+			message := m.queue[0]
+			m.mu.Unlock()
+
+			select {
+			case channel <- message:
+			case <-stop:
+				return
+			}
+			m.mu.Lock()
+			select {
+			case <-stop:
+				// Stop dropped the queue
+			default:
+				m.queue = m.queue[1:]
+			}
+			m.mu.Unlock()
+		}
+	}()
+	return
+}
+
+// mqttAcker acks `msg` to the broker, or leaves it unacked when
+// nacked.
+func mqttAcker(msg mqtt.Message) Acknowledger {
+	return ackFuncs{
+		ack: func() error {
+			msg.Ack()
+			return nil
+		},
+		nack: func(err error) error {
+			return nil
+		},
+	}
+}
+
+// mqttMessage converts an MQTT message into a message.
+func mqttMessage(msg mqtt.Message) Message {
+	return Message{
+		Payload:   msg.Payload(),
+		Key:       msg.Topic(),
+		Timestamp: time.Now(),
+		Offset:    strconv.Itoa(int(msg.MessageID())),
+		Metadata: map[string]string{
+			"topic":     msg.Topic(),
+			"qos":       strconv.Itoa(int(msg.Qos())),
+			"retained":  strconv.FormatBool(msg.Retained()),
+			"duplicate": strconv.FormatBool(msg.Duplicate()),
+		},
+	}
+}
+
+func (m *MQTT) Write(message string) (err error) {
+	return m.WriteMessage(NewMessage(message))
+}
+
+// WriteMessage publishes the payload of `message` on the topic with
+// `qos`, and waits for the broker to acknowledge it unless `qos` is
+// 0. While disconnected, the client queues the message until it
+// reconnects or `writeTimeout` passes.
+func (m *MQTT) WriteMessage(message Message) (err error) {
+	if m.client == nil {
+		return errors.New("m.client is nil")
+	}
+
+	qos := byte(mqttOptions.Int(m.Args, "qos"))
+	token := m.client.Publish(m.Topic, qos, mqttOptions.Bool(m.Args, "retain"), message.Payload)
+	if !token.WaitTimeout(mqttOptions.Duration(m.Args, "writeTimeout")) {
+		return errors.New("MQTT: Timed out publishing")
+	}
+	err = token.Error()
+	if err != nil {
+		log.Error("MQTT: Failed to publish: ", err)
+		return
+	}
+	m.health.wrote()
+
+	return
+}
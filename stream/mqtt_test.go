@@ -0,0 +1,321 @@
+package stream
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBroker is a minimal MQTT 3.1.1 broker: it forwards publishes
+// to the subscriptions of other connections, with QoS 0 and 1.
+type testBroker struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn][]string // topic filters of each connection
+	connects []*packets.ConnectPacket
+	subs     int         // subscribe packets received
+	acked    chan uint16 // message IDs acked by subscribers
+	nextID   uint16
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{listener: listener, conns: map[net.Conn][]string{}, acked: make(chan uint16, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testBroker) close() {
+	b.listener.Close()
+	b.dropAll()
+}
+
+// dropAll closes all connections, as if the network failed.
+func (b *testBroker) dropAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+		delete(b.conns, conn)
+	}
+}
+
+func (b *testBroker) subscribes() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subs
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	// b.mu also serializes writes, forward writes to other connections
+	write := func(p packets.ControlPacket) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		p.Write(conn)
+	}
+
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			b.mu.Lock()
+			delete(b.conns, conn)
+			b.mu.Unlock()
+			return
+		}
+
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			b.mu.Lock()
+			b.connects = append(b.connects, p)
+			b.conns[conn] = nil
+			b.mu.Unlock()
+			write(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			b.mu.Lock()
+			b.subs++
+			b.conns[conn] = append(b.conns[conn], p.Topics...)
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			write(ack)
+		case *packets.UnsubscribePacket:
+			b.mu.Lock()
+			b.conns[conn] = nil
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			write(ack)
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				write(ack)
+			}
+			b.forward(conn, p)
+		case *packets.PubackPacket:
+			b.acked <- p.MessageID
+		case *packets.PingreqPacket:
+			write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *testBroker) forward(from net.Conn, p *packets.PublishPacket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn, filters := range b.conns {
+		for _, filter := range filters {
+			if conn == from || !topicMatches(filter, p.TopicName) {
+				continue
+			}
+			b.nextID++
+			out := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			out.TopicName = p.TopicName
+			out.Qos = p.Qos
+			out.MessageID = b.nextID
+			out.Payload = p.Payload
+			out.Write(conn)
+		}
+	}
+}
+
+// topicMatches reports whether `topic` matches `filter`, which may
+// have + and # wildcards.
+func topicMatches(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func TestMQTT_Wildcards(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.close()
+
+	src := &MQTT{URL: b.url(), Topic: "sensors/+/temperature", Args: map[string]string{"clientId": "src", "cleanSession": "false"}}
+	dest := &MQTT{URL: b.url(), Topic: "sensors/kitchen/temperature", Args: map[string]string{"willTopic": "status/dest", "willPayload": "offline"}}
+	if !assert.NoError(t, src.Connect()) || !assert.NoError(t, dest.Connect()) {
+		return
+	}
+	defer src.Disconnect()
+	defer dest.Disconnect()
+
+	channel, err := src.ReadMessages()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, dest.Write("21.5"))
+
+	message := receive(t, channel)
+	assert.Equal(t, "21.5", message.String())
+	assert.Equal(t, "sensors/kitchen/temperature", message.Key)
+	assert.Equal(t, "1", message.Metadata["qos"])
+
+	// the broker gets the ack only once the message is acked
+	select {
+	case <-b.acked:
+		t.Error("acked before the message was")
+	case <-time.After(100 * time.Millisecond):
+	}
+	message.Ack()
+	select {
+	case <-b.acked:
+	case <-time.After(time.Second):
+		t.Error("message not acked")
+	}
+
+	b.mu.Lock()
+	assert.Equal(t, "src", b.connects[0].ClientIdentifier)
+	assert.False(t, b.connects[0].CleanSession)
+	assert.Equal(t, "status/dest", b.connects[1].WillTopic)
+	assert.Equal(t, []byte("offline"), b.connects[1].WillMessage)
+	b.mu.Unlock()
+
+	// unsubscribing closes the channel
+	assert.NoError(t, src.Stop())
+	_, ok := <-channel
+	assert.False(t, ok)
+}
+
+func TestMQTT_ResubscribeAfterReconnect(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.close()
+
+	src := &MQTT{URL: b.url(), Topic: "events/#", Args: map[string]string{"maxReconnectInterval": "100ms", "qos": "0"}}
+	if !assert.NoError(t, src.Connect()) {
+		return
+	}
+	defer src.Disconnect()
+	channel, err := src.ReadMessages()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	b.dropAll()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.subscribes() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 2, b.subscribes())
+	assert.True(t, src.Health().Connected)
+
+	dest := &MQTT{URL: b.url(), Topic: "events/a/b", Args: map[string]string{"qos": "0"}}
+	if !assert.NoError(t, dest.Connect()) {
+		return
+	}
+	defer dest.Disconnect()
+	assert.NoError(t, dest.Write("after reconnect"))
+	assert.Equal(t, "after reconnect", receive(t, channel).String())
+}
+
+func TestMQTT_ConnectInvalidArgs(t *testing.T) {
+	m := &MQTT{URL: "tcp://127.0.0.1:1", Topic: "t", Args: map[string]string{"qos": "3"}}
+	assert.True(t, IsPermanent(m.Connect()))
+}
+
+func TestMQTT_QueueSize(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.close()
+
+	src := &MQTT{URL: b.url(), Topic: "events/#", Args: map[string]string{"queueSize": "2"}}
+	dest := &MQTT{URL: b.url(), Topic: "events/a"}
+	if !assert.NoError(t, src.Connect()) || !assert.NoError(t, dest.Connect()) {
+		return
+	}
+	defer src.Disconnect()
+	defer dest.Disconnect()
+	channel, err := src.ReadMessages()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// messages received once the queue is full are dropped
+	dropped := testutil.ToFloat64(mqttDropped)
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		assert.NoError(t, dest.Write(payload))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(mqttDropped)-dropped < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(mqttDropped)-dropped)
+	assert.Equal(t, 2, src.Health().Backlog)
+
+	for _, payload := range []string{"1", "2"} {
+		message := receive(t, channel)
+		assert.Equal(t, payload, message.String())
+		message.Ack()
+	}
+}
+
+func TestMQTT_SlowConsumer(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.close()
+
+	src := &MQTT{URL: b.url(), Topic: "events/#", Args: map[string]string{"keepAlive": "2s"}}
+	dest := &MQTT{URL: b.url(), Topic: "events/a"}
+	if !assert.NoError(t, src.Connect()) || !assert.NoError(t, dest.Connect()) {
+		return
+	}
+	defer src.Disconnect()
+	defer dest.Disconnect()
+	channel, err := src.ReadMessages()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// messages are received while nothing reads the channel
+	payloads := []string{"1", "2", "3", "4", "5"}
+	for _, payload := range payloads {
+		assert.NoError(t, dest.Write(payload))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for src.Health().Backlog < len(payloads) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, len(payloads), src.Health().Backlog)
+
+	// keep-alive pings are still answered
+	time.Sleep(2500 * time.Millisecond)
+	assert.True(t, src.Health().Connected)
+	b.mu.Lock()
+	assert.Len(t, b.connects, 2)
+	b.mu.Unlock()
+
+	for _, payload := range payloads {
+		message := receive(t, channel)
+		assert.Equal(t, payload, message.String())
+		message.Ack()
+	}
+}
@@ -0,0 +1,302 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrorPolicy decides what MultiDestination does when writing to
+// one of its targets fails.
+type ErrorPolicy int
+
+const (
+	// FailAll fails the whole write, so the message is nacked.
+	FailAll ErrorPolicy = iota
+	// Skip logs and counts the error, the message is still
+	// considered written.
+	Skip
+	// Retry retries writing to the failing target only, according
+	// to its RetryPolicy, and then fails the whole write.
+	Retry
+)
+
+func (p ErrorPolicy) String() string {
+	switch p {
+	case FailAll:
+		return "fail all"
+	case Skip:
+		return "skip"
+	case Retry:
+		return "retry"
+	}
+	return fmt.Sprintf("ErrorPolicy(%d)", int(p))
+}
+
+// Target is a destination of a MultiDestination.
+type Target struct {
+	Name        string // defaults to the destination type
+	Destination Destination
+	Policy      ErrorPolicy
+	RetryPolicy *RetryPolicy // used by the Retry policy, defaults to DefaultRetryPolicy
+	stats       TargetStats
+	mu          sync.Mutex // guards stats
+	connected   bool
+}
+
+// TargetStats are the counters of a target.
+type TargetStats struct {
+	Written     uint64        // messages written
+	Failed      uint64        // messages that could not be written
+	Skipped     uint64        // failed messages ignored by the Skip policy
+	Retried     uint64        // retried writes
+	InFlight    int           // writes in progress
+	LastLatency time.Duration // duration of the last write
+	MaxLatency  time.Duration // duration of the slowest write
+}
+
+// MultiDestination writes every message to all of its targets
+// concurrently.
+//
+// A write takes as long as the slowest target, so a target stalling
+// the others shows in its InFlight and latency stats, and writes
+// slower than `SlowWrite` are logged.
+//
+// Example:
+//  dest := stream.MultiDestination{
+//      Targets: []*stream.Target{
+//          {Name: "archive", Destination: &s3, Policy: stream.Retry},
+//          {Name: "forward", Destination: &rabbitMQ, Policy: stream.Skip},
+//      },
+//  }
+type MultiDestination struct {
+	Targets   []*Target
+	SlowWrite time.Duration // 0 disables slow write warnings
+}
+
+// Connect connects all targets that are not connected yet, so that
+// it can be retried after a target failed to connect.
+func (m *MultiDestination) Connect() (err error) {
+	for _, t := range m.Targets {
+		if t.connected {
+			continue
+		}
+		err = t.Destination.Connect()
+		if err != nil {
+			return fmt.Errorf("MultiDestination: %s: %w", t.name(), err)
+		}
+		t.connected = true
+	}
+	return
+}
+
+// Disconnect disconnects all targets and logs their stats.
+func (m *MultiDestination) Disconnect() (err error) {
+	for _, t := range m.Targets {
+		if !t.connected {
+			continue
+		}
+		if e := t.Destination.Disconnect(); e != nil {
+			log.Errorf("MultiDestination: %s: %v", t.name(), e)
+			err = e
+		}
+		t.connected = false
+		log.Infof("MultiDestination: %s: %+v", t.name(), t.Stats())
+	}
+	return
+}
+
+func (m *MultiDestination) Info() {
+	for _, t := range m.Targets {
+		log.Infof("MultiDestination target %s (%s), policy: %s", t.name(), reflect.TypeOf(t.Destination), t.Policy)
+		t.Destination.Info()
+	}
+}
+
+func (m *MultiDestination) Write(message string) (err error) {
+	return m.WriteMessage(NewMessage(message))
+}
+
+// WriteMessage writes `message` to all targets and waits for them.
+//
+// If some targets defer acks, the message is acked once all of
+// them acked it.
+func (m *MultiDestination) WriteMessage(message Message) (err error) {
+	return m.WriteMessageContext(context.Background(), message)
+}
+
+// WriteMessageContext is like WriteMessage but stops retrying
+// targets with the Retry policy once ctx is done.
+//
+// Failed writes were already retried according to the policy of each
+// target, so the error returned is Permanent: a pipeline retrying it
+// would write the message to all targets again.
+func (m *MultiDestination) WriteMessageContext(ctx context.Context, message Message) (err error) {
+	var join *joinAcker
+	if n := m.deferredAcks(); n > 0 {
+		join = newJoinAcker(message, n)
+	}
+
+	errs := make([]error, len(m.Targets))
+	var wg sync.WaitGroup
+	for i, t := range m.Targets {
+		msg := message.WithAcknowledger(nil)
+		if join != nil && defersAck(t.Destination) {
+			msg = message.WithAcknowledger(join)
+		}
+
+		wg.Add(1)
+		go func(i int, t *Target, msg Message) {
+			defer wg.Done()
+			var skipped bool
+			skipped, errs[i] = m.write(ctx, t, msg)
+			// a skipped target will never ack
+			if skipped && join != nil && defersAck(t.Destination) {
+				join.Ack()
+			}
+		}(i, t, msg)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, e := range errs {
+		if e == nil {
+			continue
+		}
+		failed = append(failed, m.Targets[i].name())
+		if err == nil || (IsFatal(e) && !IsFatal(err)) {
+			err = e
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	if join != nil {
+		join.settle()
+	}
+	return Permanent(fmt.Errorf("MultiDestination: %s failed: %w", strings.Join(failed, ", "), err))
+}
+
+// DefersAck reports whether any target defers acks.
+func (m *MultiDestination) DefersAck() bool {
+	return m.deferredAcks() > 0
+}
+
+// Flush flushes all targets that buffer messages.
+func (m *MultiDestination) Flush(ctx context.Context) (pending int, err error) {
+	for _, t := range m.Targets {
+		f, ok := t.Destination.(Flusher)
+		if !ok {
+			continue
+		}
+		n, e := f.Flush(ctx)
+		pending += n
+		if e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Stats returns the stats of each target by name. A target whose
+// name is taken by a previous one is keyed by its name and index,
+// e.g. "*stream.S3#1".
+func (m *MultiDestination) Stats() map[string]TargetStats {
+	stats := map[string]TargetStats{}
+	for i, t := range m.Targets {
+		name := t.name()
+		if _, taken := stats[name]; taken {
+			name = fmt.Sprintf("%s#%d", name, i)
+		}
+		stats[name] = t.Stats()
+	}
+	return stats
+}
+
+func (m *MultiDestination) deferredAcks() (n int) {
+	for _, t := range m.Targets {
+		if defersAck(t.Destination) {
+			n++
+		}
+	}
+	return
+}
+
+// write writes `message` to `t` applying its error policy, retries
+// stop once ctx is done.
+func (m *MultiDestination) write(ctx context.Context, t *Target, message Message) (skipped bool, err error) {
+	dest := AsMessageDestination(t.Destination)
+	var policy *RetryPolicy
+	if t.Policy == Retry {
+		policy = t.RetryPolicy
+		if policy == nil {
+			policy = &DefaultRetryPolicy
+		}
+	}
+
+	attempts, err := policy.Do(ctx, func() error {
+		t.begin()
+		start := time.Now()
+		err := writeMessage(ctx, dest, message)
+		latency := time.Since(start)
+		t.end(latency)
+
+		if m.SlowWrite > 0 && latency > m.SlowWrite {
+			log.Warnf("MultiDestination: %s: slow write took %s", t.name(), latency)
+		}
+		return err
+	})
+	t.count(func(s *TargetStats) { s.Retried += uint64(attempts - 1) })
+	if err == nil {
+		t.count(func(s *TargetStats) { s.Written++ })
+		return false, nil
+	}
+
+	t.count(func(s *TargetStats) { s.Failed++ })
+	if t.Policy == Skip && !IsFatal(err) {
+		log.Errorf("MultiDestination: %s: skipping failed write: %v", t.name(), err)
+		t.count(func(s *TargetStats) { s.Skipped++ })
+		return true, nil
+	}
+	return false, fmt.Errorf("%s: %w", t.name(), err)
+}
+
+func (t *Target) name() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return reflect.TypeOf(t.Destination).String()
+}
+
+// Stats returns a copy of the target's counters.
+func (t *Target) Stats() TargetStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+func (t *Target) count(f func(s *TargetStats)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.stats)
+}
+
+func (t *Target) begin() {
+	t.count(func(s *TargetStats) { s.InFlight++ })
+}
+
+func (t *Target) end(latency time.Duration) {
+	t.count(func(s *TargetStats) {
+		s.InFlight--
+		s.LastLatency = latency
+		if latency > s.MaxLatency {
+			s.MaxLatency = latency
+		}
+	})
+}
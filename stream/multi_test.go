@@ -0,0 +1,109 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyDestination fails the first `failures` writes.
+type flakyDestination struct {
+	memoryDestination
+	failures int
+}
+
+func (d *flakyDestination) Write(message string) error {
+	if d.failures > 0 {
+		d.failures--
+		return errors.New("flaky")
+	}
+	return d.memoryDestination.Write(message)
+}
+
+func TestMultiDestination_WriteAll(t *testing.T) {
+	a, b := &memoryDestination{}, &memoryDestination{}
+	dest := &MultiDestination{Targets: []*Target{
+		{Name: "a", Destination: a},
+		{Name: "b", Destination: b},
+	}}
+	dest.Connect()
+
+	assert.NoError(t, dest.Write("x"))
+	assert.Equal(t, []string{"x"}, a.written())
+	assert.Equal(t, []string{"x"}, b.written())
+	assert.Equal(t, uint64(1), dest.Stats()["a"].Written)
+}
+
+func TestMultiDestination_Policies(t *testing.T) {
+	ok := &memoryDestination{}
+	skipped := &memoryDestination{err: errors.New("down")}
+	retried := &flakyDestination{failures: 2}
+	dest := &MultiDestination{Targets: []*Target{
+		{Name: "ok", Destination: ok},
+		{Name: "skipped", Destination: skipped, Policy: Skip},
+		{Name: "retried", Destination: retried, Policy: Retry, RetryPolicy: &RetryPolicy{MaxAttempts: 3}},
+	}}
+	dest.Connect()
+
+	assert.NoError(t, dest.Write("x"))
+
+	stats := dest.Stats()
+	assert.Equal(t, uint64(1), stats["skipped"].Skipped)
+	assert.Equal(t, uint64(2), stats["retried"].Retried)
+	assert.Equal(t, uint64(1), stats["retried"].Written)
+	assert.Equal(t, []string{"x"}, retried.written())
+}
+
+func TestMultiDestination_FailAll(t *testing.T) {
+	ok := &memoryDestination{}
+	failing := &memoryDestination{err: errors.New("down")}
+	dest := &MultiDestination{Targets: []*Target{
+		{Name: "ok", Destination: ok},
+		{Name: "failing", Destination: failing, Policy: FailAll},
+	}}
+	dest.Connect()
+
+	err := dest.Write("x")
+
+	assert.EqualError(t, err, "MultiDestination: failing failed: failing: down")
+	assert.Equal(t, uint64(1), dest.Stats()["failing"].Failed)
+}
+
+func TestMultiDestination_RetryStopsWithContext(t *testing.T) {
+	failing := &memoryDestination{err: errors.New("down")}
+	dest := &MultiDestination{Targets: []*Target{
+		{Name: "failing", Destination: failing, Policy: Retry, RetryPolicy: &RetryPolicy{InitialInterval: time.Hour}},
+	}}
+	dest.Connect()
+
+	// as when the drain deadline of the pipeline expires
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := dest.WriteMessageContext(ctx, NewMessage("x"))
+
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Minute))
+	assert.Equal(t, uint64(1), dest.Stats()["failing"].Failed)
+}
+
+func TestMultiDestination_NotRetriedByPipeline(t *testing.T) {
+	ok := &memoryDestination{}
+	failing := &memoryDestination{err: errors.New("down")}
+	dest := &MultiDestination{Targets: []*Target{
+		{Destination: ok},
+		{Destination: failing, Policy: Retry, RetryPolicy: &RetryPolicy{MaxAttempts: 2}},
+	}}
+
+	err := FlowContext(context.Background(), &sliceSource{messages: []string{"x"}, close: true}, nil, dest)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x"}, ok.written())
+	stats := dest.Stats()
+	assert.Equal(t, uint64(1), stats["*stream.memoryDestination"].Written)
+	assert.Equal(t, uint64(1), stats["*stream.memoryDestination#1"].Failed)
+	assert.Equal(t, uint64(1), stats["*stream.memoryDestination#1"].Retried)
+}
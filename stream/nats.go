@@ -0,0 +1,343 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// NATS subscribes to or publishes on a subject, either with core
+// NATS or with JetStream when the `jetstream` arg is "true".
+type NATS struct {
+	URL     string
+	Subject string
+	Args    map[string]string
+	conn    *nats.Conn
+	js      nats.JetStreamContext // set with jetstream
+	sub     *nats.Subscription    // set by Read
+	done    chan struct{}         // closed on Disconnect
+	health  healthState
+}
+
+// openNATS returns a NATS for a nats://host:4222/subject URI whose
+// query parameters set its members or Args.
+func openNATS(u *url.URL) (n *NATS, err error) {
+	n = &NATS{}
+	n.Args, err = setFields(n, query(u))
+	if err != nil {
+		return nil, err
+	}
+	if n.Subject == "" && len(u.Path) > 1 {
+		n.Subject = u.Path[1:]
+	}
+	conn := *u
+	conn.Path = ""
+	conn.RawQuery = ""
+	n.URL = conn.String()
+	return
+}
+
+var natsOptions = Options{
+	{Name: "name", Type: StringOption, Default: "manifold", Description: "connection name reported to the server"},
+	{Name: "jetstream", Type: BoolOption, Default: "false", Description: "read from a JetStream consumer and wait for JetStream to ack published messages"},
+	{Name: "queue", Type: StringOption, Usage: SourceOnly, Description: "queue group to share core NATS messages with"},
+	{Name: "durable", Type: StringOption, Usage: SourceOnly, Description: "name of the durable JetStream consumer, ephemeral if empty"},
+	{Name: "stream", Type: StringOption, Usage: SourceOnly, Description: "JetStream stream to bind to, looked up by subject if empty"},
+	{Name: "deliver", Type: StringOption, Default: "all", Usage: SourceOnly, Description: "where a new JetStream consumer starts: all, new or last"},
+	{Name: "ackWait", Type: DurationOption, Usage: SourceOnly, Description: "time JetStream waits for an ack before redelivering"},
+	{Name: "maxAckPending", Type: IntOption, Usage: SourceOnly, Description: "maximum number of unacked JetStream messages"},
+	{Name: "msgIdHeader", Type: StringOption, Default: nats.MsgIdHdr, Usage: DestinationOnly, Description: "header of messages whose value JetStream deduplicates them by"},
+}
+
+// Options returns the Args NATS accepts.
+func (n *NATS) Options() Options {
+	return natsOptions
+}
+
+func (n *NATS) Connect() (err error) {
+	err = natsOptions.Validate(n.Args, SourceAndDestination)
+	if err != nil {
+		return fmt.Errorf("NATS: %w", err)
+	}
+	if n.Subject == "" {
+		return Permanent(errors.New("NATS: Subject must be specified"))
+	}
+	switch deliver := natsOptions.String(n.Args, "deliver"); deliver {
+	case "all", "new", "last":
+	default:
+		return Permanent(fmt.Errorf("NATS: deliver must be all, new or last, not %q", deliver))
+	}
+
+	// the client reconnects on its own, health tracks it
+	log.Info("Establishing NATS connection...")
+	n.conn, err = nats.Connect(n.URL,
+		nats.Name(natsOptions.String(n.Args, "name")),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
+			if err != nil {
+				log.Error("NATS: Disconnected: ", err)
+				n.health.connected(err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			log.Info("NATS: Reconnected to ", conn.ConnectedUrl())
+			n.health.connected(nil)
+		}),
+	)
+	if err != nil {
+		log.Error("NATS: Failed to connect: ", err)
+		n.health.connected(err)
+		return
+	}
+	if natsOptions.Bool(n.Args, "jetstream") {
+		n.js, err = n.conn.JetStream()
+		if err != nil {
+			log.Error("NATS: Failed to get a JetStream context: ", err)
+			n.health.connected(err)
+			n.conn.Close()
+			n.conn = nil
+			return
+		}
+	}
+	n.done = make(chan struct{})
+	n.health.connected(nil)
+
+	return
+}
+
+// Health reports whether the connection is up and when a message
+// was last received or published.
+func (n *NATS) Health() Health {
+	return n.health.get()
+}
+
+// Stop drains the subscription started by Read: messages already
+// received are still pushed into the read channel before it is
+// closed. Durable JetStream consumers are kept.
+func (n *NATS) Stop() (err error) {
+	if n.sub == nil {
+		return
+	}
+
+	log.Info("Draining NATS subscription...")
+	err = n.sub.Drain()
+	if err != nil {
+		log.Error("NATS: Failed to drain subscription: ", err)
+	}
+	n.sub = nil
+	return
+}
+
+func (n *NATS) Disconnect() (err error) {
+	if n.conn == nil {
+		log.Warn("NATS.Disconnect(): conn is nil")
+		return
+	}
+
+	close(n.done)
+
+	log.Info("Closing NATS connection...")
+	n.health.disconnected()
+	n.conn.Close()
+	n.conn = nil
+	log.Info("NATS connection closed.")
+
+	return
+}
+
+func (n *NATS) Info() {
+	log.Info("URL: ", n.URL)
+	log.Info("Subject: ", n.Subject)
+	log.Info("Args: ", n.Args)
+}
+
+// Read subscribes to the subject, in the `queue` group if set.
+//
+// With `jetstream`, messages are read from the `durable` consumer,
+// which is created if it doesn't exist yet and starts at `deliver`.
+// Messages read with Read are acked once pushed into the channel.
+func (n *NATS) Read() (channel chan string, err error) {
+	messages, err := n.ReadMessages()
+	if err != nil {
+		return
+	}
+	return payloads(messages), nil
+}
+
+// ReadMessages is like Read but keeps the subject and headers of
+// each message, and its stream sequence with JetStream.
+//
+// JetStream messages are acked explicitly: acking a message acks it
+// and nacking it makes JetStream redeliver it. Core NATS messages
+// can't be redelivered, so they have no Acknowledger.
+func (n *NATS) ReadMessages() (channel chan Message, err error) {
+	if n.js != nil {
+		n.sub, err = n.js.SubscribeSync(n.Subject, n.subscribeOptions()...)
+	} else {
+		n.sub, err = n.conn.QueueSubscribeSync(n.Subject, n.Args["queue"])
+		if err == nil {
+			// make sure the server knows the subscription before
+			// returning, messages published earlier are missed
+			err = n.conn.Flush()
+		}
+	}
+	if err != nil {
+		log.Error("NATS: Failed to subscribe: ", err)
+		return nil, natsError(err)
+	}
+
+	channel = make(chan Message)
+	sub := n.sub
+	ctx, cancel := context.WithCancel(context.Background())
+	done := n.done
+	go func() {
+		<-done
+		cancel()
+	}()
+	go func() {
+		defer close(channel)
+		for {
+			// fails once the subscription is drained or the
+			// connection is closed
+			msg, err := sub.NextMsgWithContext(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Info("NATS: Subscription closed: ", err)
+				}
+				return
+			}
+			n.health.read()
+			log.Trace(string(msg.Data))
+
+			message := natsMessage(msg)
+			if n.js != nil {
+				message = message.WithAcknowledger(natsAcker(msg))
+			}
+
+			select {
+			case channel <- message:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return
+}
+
+// subscribeOptions returns the JetStream consumer options described
+// by Args.
+func (n *NATS) subscribeOptions() []nats.SubOpt {
+	opts := []nats.SubOpt{nats.AckExplicit()}
+	if durable := n.Args["durable"]; durable != "" {
+		opts = append(opts, nats.Durable(durable))
+	}
+	if stream := n.Args["stream"]; stream != "" {
+		opts = append(opts, nats.BindStream(stream))
+	}
+	switch natsOptions.String(n.Args, "deliver") {
+	case "all":
+		opts = append(opts, nats.DeliverAll())
+	case "new":
+		opts = append(opts, nats.DeliverNew())
+	case "last":
+		opts = append(opts, nats.DeliverLast())
+	}
+	if wait := natsOptions.Duration(n.Args, "ackWait"); wait > 0 {
+		opts = append(opts, nats.AckWait(wait))
+	}
+	if max := natsOptions.Int(n.Args, "maxAckPending"); max > 0 {
+		opts = append(opts, nats.MaxAckPending(max))
+	}
+	return opts
+}
+
+// natsAcker acks `msg` or has JetStream redeliver it when nacked.
+func natsAcker(msg *nats.Msg) Acknowledger {
+	return ackFuncs{
+		ack: func() error {
+			return msg.Ack()
+		},
+		nack: func(err error) error {
+			return msg.Nak()
+		},
+	}
+}
+
+// natsMessage converts a NATS message into a message.
+func natsMessage(msg *nats.Msg) Message {
+	message := Message{
+		Payload:   msg.Data,
+		Key:       msg.Subject,
+		Timestamp: time.Now(),
+		Metadata: map[string]string{
+			"subject": msg.Subject,
+		},
+	}
+	if len(msg.Header) > 0 {
+		message.Headers = map[string]string{}
+		for name := range msg.Header {
+			message.Headers[name] = msg.Header.Get(name)
+		}
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		message.Timestamp = meta.Timestamp
+		message.Offset = strconv.FormatUint(meta.Sequence.Stream, 10)
+		message.Metadata["stream"] = meta.Stream
+		message.Metadata["consumer"] = meta.Consumer
+		message.Metadata["redelivered"] = strconv.FormatBool(meta.NumDelivered > 1)
+	}
+	return message
+}
+
+func (n *NATS) Write(message string) (err error) {
+	return n.WriteMessage(NewMessage(message))
+}
+
+// WriteMessage publishes `message` on the subject with its headers.
+//
+// With `jetstream`, it waits for JetStream to ack the message, which
+// is deduplicated by the value of its `msgIdHeader` header if set.
+func (n *NATS) WriteMessage(message Message) (err error) {
+	msg := nats.NewMsg(n.Subject)
+	msg.Data = message.Payload
+	for name, value := range message.Headers {
+		msg.Header.Set(name, value)
+	}
+
+	if n.js != nil {
+		var opts []nats.PubOpt
+		if id := message.Headers[natsOptions.String(n.Args, "msgIdHeader")]; id != "" {
+			opts = append(opts, nats.MsgId(id))
+		}
+		var ack *nats.PubAck
+		ack, err = n.js.PublishMsg(msg, opts...)
+		if err == nil && ack.Duplicate {
+			log.Debugf("NATS: Duplicate of message %d of stream %s", ack.Sequence, ack.Stream)
+		}
+	} else {
+		err = n.conn.PublishMsg(msg)
+	}
+	if err != nil {
+		log.Error("NATS: Failed to publish: ", err)
+		return natsError(err)
+	}
+	n.health.wrote()
+
+	return
+}
+
+// natsError marks errors that retrying can't fix, such as an invalid
+// subject or a message larger than the server allows, as permanent.
+func natsError(err error) error {
+	if errors.Is(err, nats.ErrBadSubject) || errors.Is(err, nats.ErrMaxPayload) {
+		return Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package stream
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// runNATSServer starts an embedded server with JetStream enabled.
+func runNATSServer(t *testing.T) (s *server.Server, stop func()) {
+	dir, err := ioutil.TempDir("", "manifold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	return s, func() {
+		s.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
+
+func receive(t *testing.T, channel chan Message) Message {
+	select {
+	case message := <-channel:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return Message{}
+}
+
+func TestNATS_Core(t *testing.T) {
+	s, stop := runNATSServer(t)
+	defer stop()
+
+	src := &NATS{URL: s.ClientURL(), Subject: "events.>", Args: map[string]string{"queue": "q"}}
+	dest := &NATS{URL: s.ClientURL(), Subject: "events.a"}
+	if !assert.NoError(t, src.Connect()) || !assert.NoError(t, dest.Connect()) {
+		return
+	}
+	defer src.Disconnect()
+	defer dest.Disconnect()
+
+	channel, err := src.ReadMessages()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, dest.WriteMessage(Message{Payload: []byte("hello"), Headers: map[string]string{"h": "1"}}))
+
+	message := receive(t, channel)
+	assert.Equal(t, "hello", message.String())
+	assert.Equal(t, "events.a", message.Key)
+	assert.Equal(t, map[string]string{"h": "1"}, message.Headers)
+	assert.True(t, dest.Health().Connected)
+	assert.NotNil(t, src.Health().LastRead)
+
+	// draining closes the channel
+	assert.NoError(t, src.Stop())
+	_, ok := <-channel
+	assert.False(t, ok)
+}
+
+func TestNATS_JetStream(t *testing.T) {
+	s, stop := runNATSServer(t)
+	defer stop()
+
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, _ := conn.JetStream()
+	_, err = js.AddStream(&nats.StreamConfig{Name: "EVENTS", Subjects: []string{"events.>"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// messages with the same ID are stored once
+	dest := &NATS{URL: s.ClientURL(), Subject: "events.a", Args: map[string]string{"jetstream": "true"}}
+	if !assert.NoError(t, dest.Connect()) {
+		return
+	}
+	defer dest.Disconnect()
+	for _, payload := range []string{"a", "a", "b"} {
+		err := dest.WriteMessage(Message{Payload: []byte(payload), Headers: map[string]string{nats.MsgIdHdr: payload}})
+		assert.NoError(t, err)
+	}
+	info, err := js.StreamInfo("EVENTS")
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(2), info.State.Msgs)
+	}
+
+	src := &NATS{URL: s.ClientURL(), Subject: "events.>", Args: map[string]string{"jetstream": "true", "durable": "d", "ackWait": "1s"}}
+	if !assert.NoError(t, src.Connect()) {
+		return
+	}
+	defer src.Disconnect()
+	channel, err := src.ReadMessages()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	a := receive(t, channel)
+	assert.Equal(t, "a", a.String())
+	assert.Equal(t, "1", a.Offset)
+	assert.Equal(t, "EVENTS", a.Metadata["stream"])
+	assert.NoError(t, a.Ack())
+
+	// nacked messages are redelivered
+	b := receive(t, channel)
+	assert.NoError(t, b.Nack(assert.AnError))
+	b = receive(t, channel)
+	assert.Equal(t, "b", b.String())
+	assert.Equal(t, "true", b.Metadata["redelivered"])
+	assert.NoError(t, b.Ack())
+
+	// the durable consumer outlives the subscription
+	assert.NoError(t, src.Stop())
+	_, ok := <-channel
+	assert.False(t, ok)
+	_, err = js.ConsumerInfo("EVENTS", "d")
+	assert.NoError(t, err)
+}
+
+func TestNATS_ConnectInvalidArgs(t *testing.T) {
+	n := &NATS{URL: "nats://127.0.0.1:1", Subject: "events", Args: map[string]string{"deliver": "first"}}
+	assert.True(t, IsPermanent(n.Connect()))
+}
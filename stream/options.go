@@ -0,0 +1,180 @@
+package stream
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OptionType is the type of the value of an option.
+type OptionType string
+
+const (
+	StringOption   OptionType = "string"
+	IntOption      OptionType = "int"
+	BoolOption     OptionType = "bool"
+	DurationOption OptionType = "duration" // e.g. "12h", or nanoseconds
+)
+
+// Usage tells when an option applies to a connector.
+type Usage int
+
+const (
+	// SourceAndDestination options apply to all connectors.
+	SourceAndDestination Usage = iota
+	// SourceOnly options apply to connectors used as sources.
+	SourceOnly
+	// DestinationOnly options apply to connectors used as
+	// destinations.
+	DestinationOnly
+)
+
+func (u Usage) String() string {
+	switch u {
+	case SourceOnly:
+		return "source"
+	case DestinationOnly:
+		return "destination"
+	}
+	return "source, destination"
+}
+
+// Option describes an argument a connector accepts in its Args.
+type Option struct {
+	Name        string
+	Type        OptionType
+	Default     string // used when the arg is not set
+	Required    bool   // required when the connector is used as `Usage` says
+	Usage       Usage
+	Description string
+}
+
+// Options is the schema of the Args of a connector.
+//
+// Example:
+//
+//	var ftpOptions = stream.Options{
+//	    {Name: "path", Type: stream.StringOption, Required: true, Usage: stream.SourceOnly, Description: "file to read"},
+//	    {Name: "timeout", Type: stream.DurationOption, Default: "30s", Description: "connection timeout"},
+//	}
+type Options []Option
+
+// Configurable is implemented by connectors that declare the Args
+// they accept. Such connectors validate their Args on Connect.
+type Configurable interface {
+	Options() Options
+}
+
+// OptionsError lists the problems found in Args.
+type OptionsError struct {
+	Problems []string
+}
+
+func (e *OptionsError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// Validate checks that `args` only has known options with values of
+// the right type, and that the options required for `usage` are
+// set. Options required for SourceOnly or DestinationOnly are only
+// checked when `usage` is the same.
+//
+// The returned error is an *OptionsError marked with Permanent.
+func (o Options) Validate(args map[string]string, usage Usage) error {
+	var problems []string
+
+	var names []string
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		opt, ok := o.Lookup(name)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown arg %q", name))
+			continue
+		}
+		if err := opt.check(args[name]); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	for _, opt := range o {
+		if !opt.Required || (opt.Usage != SourceAndDestination && opt.Usage != usage) {
+			continue
+		}
+		if _, ok := args[opt.Name]; !ok {
+			problems = append(problems, fmt.Sprintf("missing required arg %q", opt.Name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return Permanent(&OptionsError{Problems: problems})
+	}
+	return nil
+}
+
+// Lookup returns the option called `name`.
+func (o Options) Lookup(name string) (Option, bool) {
+	for _, opt := range o {
+		if opt.Name == name {
+			return opt, true
+		}
+	}
+	return Option{}, false
+}
+
+// String returns the arg `name`, or its default.
+func (o Options) String(args map[string]string, name string) string {
+	if v, ok := args[name]; ok {
+		return v
+	}
+	opt, _ := o.Lookup(name)
+	return opt.Default
+}
+
+// Int returns the arg `name` as an int, or 0 if it isn't one.
+func (o Options) Int(args map[string]string, name string) int {
+	n, _ := strconv.Atoi(o.String(args, name))
+	return n
+}
+
+// Bool returns the arg `name` as a bool, or false if it isn't one.
+func (o Options) Bool(args map[string]string, name string) bool {
+	b, _ := strconv.ParseBool(o.String(args, name))
+	return b
+}
+
+// Duration returns the arg `name` as a duration, or 0 if it isn't
+// one.
+func (o Options) Duration(args map[string]string, name string) time.Duration {
+	d, _ := parseDuration(o.String(args, name))
+	return d
+}
+
+// check checks that `value` is of the option's type.
+func (opt Option) check(value string) (err error) {
+	switch opt.Type {
+	case IntOption:
+		_, err = strconv.Atoi(value)
+	case BoolOption:
+		_, err = strconv.ParseBool(value)
+	case DurationOption:
+		_, err = parseDuration(value)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a valid %s", opt.Name, value, opt.Type)
+	}
+	return nil
+}
+
+// parseDuration parses durations like "12h", as well as integers
+// that are nanoseconds.
+func parseDuration(value string) (time.Duration, error) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(n), nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testOptions = Options{
+	{Name: "queue", Type: StringOption, Required: true, Usage: SourceOnly},
+	{Name: "exchange", Type: StringOption, Required: true, Usage: DestinationOnly},
+	{Name: "prefetch", Type: IntOption},
+	{Name: "autoAck", Type: BoolOption, Default: "true"},
+	{Name: "every", Type: DurationOption, Default: "1m"},
+}
+
+func TestOptions_Validate(t *testing.T) {
+	assert.NoError(t, testOptions.Validate(map[string]string{"queue": "q", "prefetch": "10", "every": "12h"}, SourceOnly))
+	assert.NoError(t, testOptions.Validate(map[string]string{"exchange": "e"}, DestinationOnly))
+	assert.NoError(t, testOptions.Validate(map[string]string{}, SourceAndDestination))
+
+	err := testOptions.Validate(map[string]string{"prefetch": "ten", "autoAck": "maybe", "every": "soon", "queu": "q"}, SourceOnly)
+	assert.True(t, IsPermanent(err))
+	var optsErr *OptionsError
+	if assert.True(t, errors.As(err, &optsErr)) {
+		assert.Equal(t, []string{
+			`autoAck: "maybe" is not a valid bool`,
+			`every: "soon" is not a valid duration`,
+			`prefetch: "ten" is not a valid int`,
+			`unknown arg "queu"`,
+			`missing required arg "queue"`,
+		}, optsErr.Problems)
+	}
+}
+
+func TestOptions_Getters(t *testing.T) {
+	args := map[string]string{"prefetch": "10", "every": "3600000000000"}
+	assert.Equal(t, 10, testOptions.Int(args, "prefetch"))
+	assert.Equal(t, true, testOptions.Bool(args, "autoAck"))
+	assert.Equal(t, time.Hour, testOptions.Duration(args, "every"))
+	assert.Equal(t, time.Minute, testOptions.Duration(map[string]string{}, "every"))
+	assert.Equal(t, "", testOptions.String(args, "queue"))
+}
+
+func TestConnect_InvalidOptions(t *testing.T) {
+	w := &WebSocket{URL: "ws://localhost:1", Args: map[string]string{"reconnect_every": "often"}}
+	err := w.Connect()
+	assert.True(t, IsPermanent(err))
+	assert.Contains(t, err.Error(), `reconnect_every: "often" is not a valid duration`)
+}
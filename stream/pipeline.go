@@ -1,12 +1,18 @@
 package stream
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"os"
 	"os/signal"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/abstractpaper/manifold/transform"
-	swissFunc "github.com/abstractpaper/swissarmy/function"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -31,8 +37,101 @@ type Destination interface {
 	Write(message string) error
 }
 
+// Flusher is implemented by destinations that buffer messages
+// before persisting them, such as S3.
+type Flusher interface {
+	// Flush blocks until every message passed to Write has been
+	// persisted or ctx is done, and returns the number of messages
+	// that are still pending.
+	Flush(ctx context.Context) (pending int, err error)
+}
+
+// Stopper is implemented by sources that can stop reading while
+// staying connected, so that messages already read can still be
+// drained and acknowledged before Disconnect is called.
+type Stopper interface {
+	// Stop stops reading new messages. The channel returned by
+	// Read is closed once in-flight messages have been pushed.
+	Stop() error
+}
+
+// DefaultDrainTimeout is used when Pipeline.DrainTimeout is zero.
+const DefaultDrainTimeout = 30 * time.Second
+
+// drainIdle is how long dispatch keeps reading the channel of a
+// disconnected source that is not a Stopper before giving up on it.
+const drainIdle = 100 * time.Millisecond
+
 type stat struct {
-	count uint64
+	read         uint64
+	count        uint64
+	failed       uint64
+	retried      uint64
+	deadLettered uint64
+	metrics      *pipelineMetrics
+}
+
+// written counts `n` messages written.
+func (s *stat) written(n int) {
+	atomic.AddUint64(&s.count, uint64(n))
+	s.metrics.written.Add(float64(n))
+	s.metrics.inFlight.Sub(float64(n))
+}
+
+// fail counts `n` messages that failed at `stage` because of `err`.
+func (s *stat) fail(stage Stage, err error, n int) {
+	atomic.AddUint64(&s.failed, uint64(n))
+	s.metrics.failed(stage, err, n)
+	s.metrics.inFlight.Sub(float64(n))
+}
+
+// Pipeline reads from `Source`, optionally transforms each
+// message with `Transformer` and writes it to `Destination`.
+//
+// Unlike Flow, a Pipeline does not handle OS signals; it runs
+// until its context is cancelled, the source is exhausted or a
+// fatal error occurs.
+//
+// On shutdown the source is disconnected first, messages already
+// read are written to the destination, a Flusher destination is
+// flushed and only then the destination is disconnected. The whole
+// sequence is bounded by `DrainTimeout`.
+//
+// Messages are transformed and written by `Workers` goroutines (1
+// by default), in which case the transformer and destination must
+// be safe for concurrent use. With `OrderByKey`, messages with the
+// same key are always handled by the same worker so that their
+// order is preserved.
+//
+// If `Batch` is set and the destination is a BatchDestination,
+// transformed messages are grouped into batches according to it and
+// written with WriteBatch. Each worker has its own batches, so that
+// they are written concurrently and, with `OrderByKey`, in key order.
+// Only the messages of a batch that failed are retried, after the
+// others of the batch were written.
+//
+// Failed writes are retried according to `Retry`, or the retry
+// policy of the destination if it is a Retrier. Messages that fail
+// to be transformed or written are never written partially. If
+// `DeadLetter` is set they are wrapped in a DeadLetter and written
+// to it, otherwise they are nacked.
+//
+// Metrics about the messages flowing through the pipeline are
+// exported to Prometheus. If `HTTPAddr` is set, they are served on
+// /metrics along with the /healthz and /readyz probes, see
+// HealthHandler and ReadyHandler.
+type Pipeline struct {
+	Source       Source
+	Transformer  transform.Transformer
+	Destination  Destination
+	DeadLetter   Destination
+	Retry        *RetryPolicy
+	Batch        *BatchPolicy // enables batching for a BatchDestination, messages are written one at a time if nil
+	Workers      int
+	OrderByKey   bool
+	DrainTimeout time.Duration
+	HTTPAddr     string // address to serve /metrics, /healthz and /readyz on, e.g. ":9090", disabled if empty
+	flowing      int32  // 1 while data flows, see ReadyHandler
 }
 
 // Flow connects to source and destination and then launches a
@@ -41,6 +140,12 @@ type stat struct {
 // A transformer is optional and can be used to to transform
 // data read from `src` before writing it to `dest`.
 //
+// Flow blocks until SIGINT is received. Use FlowContext to
+// control the pipeline's lifetime from code.
+//
+// Failed writes are retried according to DefaultRetryPolicy, or the
+// retry policy of `dest` if it is a Retrier.
+//
 // Example:
 //  transform := transformer.JSON{
 //      Append: map[string]interface{}{
@@ -52,52 +157,563 @@ func Flow(src Source, transformer transform.Transformer, dest Destination) {
 	interrupt := make(chan os.Signal, 1)
 	// register interrupt channel to receive SIGINT and SIGKILL
 	signal.Notify(interrupt, os.Interrupt, os.Kill)
+	defer signal.Stop(interrupt)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-interrupt:
+			log.Info("Interrupt received.")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := FlowContext(ctx, src, transformer, dest)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// FlowContext is like Flow but stops when ctx is done instead
+// of waiting for an OS signal, and returns the first fatal error
+// from `src.Read` or `dest.Write`.
+//
+// FlowContext returns nil when the pipeline is stopped through
+// ctx or when the source channel is closed.
+func FlowContext(ctx context.Context, src Source, transformer transform.Transformer, dest Destination) error {
+	p := &Pipeline{
+		Source:      src,
+		Transformer: transformer,
+		Destination: dest,
+		Retry:       &DefaultRetryPolicy,
+	}
+	return p.Run(ctx)
+}
+
+// Run connects to the source and destination, retrying until
+// they succeed, fail with a permanent error such as invalid Args, or
+// ctx is done, and then flows data between them.
+//
+// Source and destination are disconnected before Run returns. If
+// the drain deadline expires, Run returns an error wrapping
+// ErrDrainTimeout with the number of lost messages.
+func (p *Pipeline) Run(ctx context.Context) (err error) {
+	stopHTTP := p.serveHTTP()
+	defer stopHTTP()
 
 	// Connect
-	swissFunc.Retry(src.Connect, interrupt)
-	swissFunc.Retry(dest.Connect, interrupt)
+	if err = retry(ctx, p.Source.Connect); err != nil {
+		return connectError("src", err)
+	}
+	for i, dest := range p.destinations() {
+		if err = retry(ctx, dest.Connect); err != nil {
+			p.Source.Disconnect()
+			for _, dest := range p.destinations()[:i] {
+				dest.Disconnect()
+			}
+			return connectError("dest", err)
+		}
+	}
 
-	log.Info("Source is: ", reflect.TypeOf(src))
-	src.Info()
-	log.Info("Destination is: ", reflect.TypeOf(dest))
-	dest.Info()
-	if transformer != nil {
-		transformer.Info()
+	log.Info("Source is: ", reflect.TypeOf(p.Source))
+	p.Source.Info()
+	log.Info("Destination is: ", reflect.TypeOf(p.Destination))
+	p.Destination.Info()
+	if p.DeadLetter != nil {
+		log.Info("Dead-letter destination is: ", reflect.TypeOf(p.DeadLetter))
+		p.DeadLetter.Info()
+	}
+	if p.Transformer != nil {
+		p.Transformer.Info()
 	}
 
+	channel, err := AsMessageSource(p.Source).ReadMessages()
+	if err != nil {
+		p.Source.Disconnect()
+		for _, dest := range p.destinations() {
+			dest.Disconnect()
+		}
+		return fmt.Errorf("src.Read(): %w", err)
+	}
+
+	log.Info("Flowing data...")
+	atomic.StoreInt32(&p.flowing, 1)
+
 	// do something!
-	var stat stat
+	dest := AsMessageDestination(p.Destination)
+	stat := stat{metrics: newPipelineMetrics(p.Source, p.Destination)}
+	var fatal error
+	done := make(chan struct{})
+	// closed to stop reading the source channel
+	drain := make(chan struct{})
+	// cancelled when the drain deadline expires to stop retries
+	work, stopWork := context.WithCancel(context.Background())
+	defer stopWork()
 	go func() {
-		channel, err := src.Read()
+		defer close(done)
+		fatal = p.dispatch(work, channel, drain, dest, &stat)
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Info("Stopping pipeline...")
+	case <-done:
+	}
+
+	atomic.StoreInt32(&p.flowing, 0)
+	err = p.shutdown(done, drain, stopWork, &stat)
+	select {
+	case <-done:
+		if fatal != nil {
+			return fatal
+		}
+	default:
+	}
+	return err
+}
+
+// shutdown stops the source, waits for `done` to be closed once
+// in-flight messages are written, flushes and disconnects the
+// destination and finally disconnects a Stopper source.
+//
+// A Stopper source closes its channel once the messages it received
+// are read. Other sources are disconnected right away and may never
+// close their channel, so `drain` is closed for dispatch to stop
+// reading it once the messages already pushed are taken. It is closed
+// as well when the drain deadline expires.
+func (p *Pipeline) shutdown(done, drain chan struct{}, stopWork context.CancelFunc, stat *stat) (err error) {
+	timeout := p.DrainTimeout
+	if timeout == 0 {
+		timeout = DefaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// stop reading new messages
+	stopper, stoppable := p.Source.(Stopper)
+	if stoppable {
+		err = stopper.Stop()
 		if err != nil {
-			log.Fatal("src.Read(): ", err)
+			log.Error("Failed to stop source: ", err)
+		}
+	} else {
+		p.Source.Disconnect()
+		close(drain)
+	}
+
+	// drain messages that were already read
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("Drain deadline exceeded while writing in-flight messages.")
+		stopWork()
+		if stoppable {
+			close(drain)
 		}
+	}
 
-		log.Info("Flowing data...")
+	// persist buffered messages
+	var pending int
+	for _, dest := range p.destinations() {
+		if f, ok := dest.(Flusher); ok {
+			n, err := f.Flush(ctx)
+			if err != nil {
+				log.Error("Failed to flush destination: ", err)
+			}
+			pending += n
+		}
+	}
 
-		for message := range channel {
-			if transformer != nil {
-				var err error
-				message, err = transformer.Transform(message)
+	for _, dest := range p.destinations() {
+		dest.Disconnect()
+	}
+	if stoppable {
+		p.Source.Disconnect()
+	}
+
+	count := atomic.LoadUint64(&stat.count)
+	inFlight := atomic.LoadUint64(&stat.read) - count - atomic.LoadUint64(&stat.failed)
+	log.Info("Sent messages: ", count)
+	log.Info("Retried writes: ", atomic.LoadUint64(&stat.retried))
+	if p.DeadLetter != nil {
+		log.Info("Dead-lettered messages: ", atomic.LoadUint64(&stat.deadLettered))
+	}
+
+	lost := inFlight + uint64(pending)
+	if ctx.Err() == nil || lost == 0 {
+		return nil
+	}
+	log.Errorf("Drain deadline exceeded, %d messages lost.", lost)
+	return fmt.Errorf("%w: %d messages lost", ErrDrainTimeout, lost)
+}
+
+// dispatch hands messages read from `channel` over to the workers
+// until the channel is closed, it stays idle after `drain` is closed
+// or a worker fails with a fatal error, which is returned once all
+// workers are done.
+func (p *Pipeline) dispatch(ctx context.Context, channel chan Message, drain chan struct{}, dest MessageDestination, stat *stat) (fatal error) {
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// one queue per worker to order by key, otherwise a shared one
+	queues := make([]chan Message, 1)
+	if p.OrderByKey {
+		queues = make([]chan Message, workers)
+	}
+	for i := range queues {
+		queues[i] = make(chan Message)
+	}
+
+	var once sync.Once
+	stop := make(chan struct{})
+	fail := func(err error) {
+		once.Do(func() {
+			fatal = err
+			close(stop)
+		})
+	}
+
+	// workers hand transformed messages over to their own batcher
+	batchDest, batching := p.Destination.(BatchDestination)
+	batching = batching && p.Batch != nil
+	writeBatch := func(batch []entry) {
+		select {
+		case <-stop:
+			stat.fail(StageWrite, errPipelineStopped, len(batch))
+			for _, e := range batch {
+				p.nack(e.message, errPipelineStopped)
+			}
+			return
+		default:
+		}
+		if err := p.writeBatch(ctx, batchDest, batch, stat); err != nil {
+			fail(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(queue chan Message) {
+			defer wg.Done()
+			var entries chan entry
+			if batching {
+				entries = make(chan entry)
+				batched := make(chan struct{})
+				b := batcher{policy: *p.Batch, write: writeBatch}
+				go func() {
+					defer close(batched)
+					b.run(entries)
+				}()
+				defer func() {
+					close(entries)
+					<-batched
+				}()
+			}
+			for message := range queue {
+				err := p.process(ctx, message, dest, entries, stat)
 				if err != nil {
-					log.Error("Failed to transform message: ", err)
+					fail(err)
 				}
 			}
-			err := dest.Write(message)
+		}(queues[i%len(queues)])
+	}
+
+	next := 0
+	// fires once the channel stays idle after the drain started
+	var idle <-chan time.Time
+loop:
+	for {
+		var message Message
+		select {
+		case <-stop:
+			break loop
+		case <-drain:
+			// take messages the source already pushed
+			drain = nil
+			idle = time.After(drainIdle)
+			continue
+		case <-idle:
+			log.Info("Source stopped, not reading its channel anymore.")
+			break loop
+		case m, ok := <-channel:
+			if !ok {
+				log.Info("Source channel closed.")
+				break loop
+			}
+			message = m
+			if idle != nil {
+				idle = time.After(drainIdle)
+			}
+		}
+		atomic.AddUint64(&stat.read, 1)
+		stat.metrics.read.Inc()
+		stat.metrics.inFlight.Inc()
+
+		i := next % len(queues)
+		next++
+		if p.OrderByKey && message.Key != "" {
+			h := fnv.New32a()
+			h.Write([]byte(message.Key))
+			i = int(h.Sum32() % uint32(len(queues)))
+		}
+
+		select {
+		case queues[i] <- message:
+		case <-stop:
+			stat.fail(StageWrite, errPipelineStopped, 1)
+			p.nack(message, errPipelineStopped)
+			break loop
+		}
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	return
+}
+
+// process transforms the payload of `message` and writes it to
+// `dest`, retrying failed writes until ctx is done. Only fatal write
+// errors are returned, others are logged and the message is
+// dead-lettered.
+//
+// The message is acked once written, unless the destination defers
+// acks, and nacked if it could not be written.
+//
+// If `entries` is not nil, the transformed message is sent to it to
+// be written in a batch instead.
+func (p *Pipeline) process(ctx context.Context, message Message, dest MessageDestination, entries chan entry, stat *stat) (err error) {
+	original := message
+	if p.Transformer != nil {
+		var payload string
+		start := time.Now()
+		payload, err = p.Transformer.Transform(string(message.Payload))
+		since(stat.metrics.transform, start)
+		if err != nil {
+			log.Error("Failed to transform message: ", err)
+			stat.fail(StageTransform, err, 1)
+			p.deadLetter(original, StageTransform, err, 1, stat)
+			return nil
+		}
+		message.Payload = []byte(payload)
+		stat.metrics.transformed.Inc()
+	}
+
+	if entries != nil {
+		entries <- entry{message: message, original: original}
+		return nil
+	}
+
+	attempts, err := p.retryPolicy().Do(ctx, func() error {
+		defer since(stat.metrics.write, time.Now())
+		return writeMessage(ctx, dest, message)
+	})
+	atomic.AddUint64(&stat.retried, uint64(attempts-1))
+	if err == nil {
+		stat.written(1)
+		if !defersAck(p.Destination) {
+			p.ack(message)
+		}
+		return nil
+	}
+	stat.fail(StageWrite, err, 1)
+	if IsFatal(err) {
+		p.nack(message, err)
+		return fmt.Errorf("dest.Write(): %w", err)
+	}
+	log.Error(err)
+	p.deadLetter(original, StageWrite, err, attempts, stat)
+	return nil
+}
+
+// writeBatch writes `batch` to `dest`, retrying the messages that
+// failed until ctx is done. Like process, it only returns fatal
+// errors, other failed messages are dead-lettered, and messages
+// failing with a permanent error are not retried.
+func (p *Pipeline) writeBatch(ctx context.Context, dest BatchDestination, batch []entry, stat *stat) (err error) {
+	pending := batch
+	var attempts int
+	_, err = p.retryPolicy().Do(ctx, func() error {
+		attempts++
+		messages := make([]Message, len(pending))
+		for i, e := range pending {
+			messages[i] = e.message
+		}
+
+		start := time.Now()
+		err := dest.WriteBatch(messages)
+		since(stat.metrics.write, start)
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) {
 			if err == nil {
-				stat.count++
-			} else {
+				p.written(pending, stat)
+				pending = nil
+			}
+			return err
+		}
+
+		var failed []entry
+		var last error
+		for i, e := range pending {
+			var err error
+			if i < len(batchErr.Errors) {
+				err = batchErr.Errors[i]
+			}
+			switch {
+			case err == nil:
+				p.written([]entry{e}, stat)
+			case IsPermanent(err) && !IsFatal(err):
 				log.Error(err)
+				stat.fail(StageWrite, err, 1)
+				p.deadLetter(e.original, StageWrite, err, attempts, stat)
+			default:
+				failed = append(failed, e)
+				if last == nil || IsFatal(err) {
+					last = err
+				}
 			}
 		}
-	}()
+		pending = failed
+		return last
+	})
+	atomic.AddUint64(&stat.retried, uint64(attempts-1))
+	if len(pending) == 0 {
+		return nil
+	}
+
+	stat.fail(StageWrite, err, len(pending))
+	if IsFatal(err) {
+		for _, e := range pending {
+			p.nack(e.message, err)
+		}
+		return fmt.Errorf("dest.WriteBatch(): %w", err)
+	}
+	log.Error(err)
+	for _, e := range pending {
+		p.deadLetter(e.original, StageWrite, err, attempts, stat)
+	}
+	return nil
+}
+
+// written counts and acks entries written by a batch.
+func (p *Pipeline) written(entries []entry, stat *stat) {
+	stat.written(len(entries))
+	if defersAck(p.Destination) {
+		return
+	}
+	for _, e := range entries {
+		p.ack(e.message)
+	}
+}
+
+// deadLetter writes `message` that failed at `stage` to the
+// dead-letter destination and acks it, or nacks it if there is no
+// dead-letter destination or writing to it failed.
+func (p *Pipeline) deadLetter(message Message, stage Stage, cause error, attempts int, stat *stat) {
+	if p.DeadLetter == nil {
+		p.nack(message, cause)
+		return
+	}
 
-	// Interrupt received
-	<-interrupt
-	log.Info("Interrupt received.")
-	log.Info("Sent messages: ", stat.count)
+	letter := NewDeadLetter(message, stage, cause, attempts).Message()
+	deferred := defersAck(p.DeadLetter)
+	if deferred {
+		letter = letter.WithAcknowledger(message.acker)
+	}
+
+	err := AsMessageDestination(p.DeadLetter).WriteMessage(letter)
+	if err != nil {
+		log.Error("Failed to write to dead-letter destination: ", err)
+		p.nack(message, cause)
+		return
+	}
+	atomic.AddUint64(&stat.deadLettered, 1)
+	if !deferred {
+		p.ack(message)
+	}
+}
 
-	// Disconnect
-	src.Disconnect()
-	dest.Disconnect()
+func (p *Pipeline) ack(message Message) {
+	err := message.Ack()
+	if err != nil {
+		log.Error("Failed to ack message: ", err)
+	}
+}
+
+func (p *Pipeline) nack(message Message, cause error) {
+	err := message.Nack(cause)
+	if err != nil {
+		log.Error("Failed to nack message: ", err)
+	}
+}
+
+// retryPolicy returns the retry policy of the destination if it has
+// one, or Retry.
+func (p *Pipeline) retryPolicy() *RetryPolicy {
+	if r, ok := p.Destination.(Retrier); ok && r.RetryPolicy() != nil {
+		return r.RetryPolicy()
+	}
+	return p.Retry
+}
+
+// destinations returns the destination and the dead-letter
+// destination, if set.
+func (p *Pipeline) destinations() []Destination {
+	if p.DeadLetter == nil {
+		return []Destination{p.Destination}
+	}
+	return []Destination{p.Destination, p.DeadLetter}
+}
+
+// defersAck reports whether `dest` acks messages itself.
+func defersAck(dest Destination) bool {
+	d, ok := dest.(DeferredAcker)
+	return ok && d.DefersAck()
+}
+
+// connectError returns the error that made connecting to `name`
+// fail, or nil if it was interrupted by the context.
+func connectError(name string, err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	return fmt.Errorf("%s.Connect(): %w", name, err)
+}
+
+// retry calls f until it succeeds, fails with a permanent error or
+// ctx is done. It waits for a period that starts with 2 seconds and
+// increases exponentially until it is capped at ~1 minute.
+func retry(ctx context.Context, f func() error) error {
+	sleep := 2 * time.Second
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if IsPermanent(err) {
+			log.Error(err)
+			return err
+		}
+
+		// failed; retry.
+		log.Error(err)
+		log.Info("Retrying in ", sleep)
+		select {
+		case <-ctx.Done():
+			log.Warn("Context done, quitting.")
+			return ctx.Err()
+		case <-time.After(sleep):
+		}
+
+		// increase exponentially, cap at ~ 1 minute (64 seconds).
+		if sleep < 64*time.Second {
+			sleep = sleep * 2
+		}
+	}
 }
@@ -0,0 +1,373 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sliceSource emits `messages` and then keeps its channel open
+// until Disconnect is called, unless `close` is set.
+type sliceSource struct {
+	messages []string
+	close    bool
+	done     chan struct{}
+}
+
+func (s *sliceSource) Connect() error {
+	s.done = make(chan struct{})
+	return nil
+}
+
+func (s *sliceSource) Disconnect() error {
+	close(s.done)
+	return nil
+}
+
+func (s *sliceSource) Info() {}
+
+func (s *sliceSource) Read() (chan string, error) {
+	channel := make(chan string)
+	go func() {
+		defer close(channel)
+		for _, m := range s.messages {
+			select {
+			case channel <- m:
+			case <-s.done:
+				return
+			}
+		}
+		if !s.close {
+			<-s.done
+		}
+	}()
+	return channel, nil
+}
+
+// memoryDestination records written messages.
+type memoryDestination struct {
+	mu       sync.Mutex
+	messages []string
+	err      error
+	delay    time.Duration
+}
+
+func (d *memoryDestination) Connect() error    { return nil }
+func (d *memoryDestination) Disconnect() error { return nil }
+func (d *memoryDestination) Info()             {}
+
+func (d *memoryDestination) Write(message string) error {
+	if d.err != nil {
+		return d.err
+	}
+	time.Sleep(d.delay)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.messages = append(d.messages, message)
+	return nil
+}
+
+func (d *memoryDestination) written() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.messages...)
+}
+
+func TestFlowContext_SourceClosed(t *testing.T) {
+	src := &sliceSource{messages: []string{"a", "b", "c"}, close: true}
+	dest := &memoryDestination{}
+
+	err := FlowContext(context.Background(), src, nil, dest)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, dest.written())
+}
+
+func TestFlowContext_Cancel(t *testing.T) {
+	src := &sliceSource{messages: []string{"a"}}
+	dest := &memoryDestination{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- FlowContext(ctx, src, nil, dest)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("FlowContext did not return after cancel")
+	}
+	assert.Equal(t, []string{"a"}, dest.written())
+}
+
+func TestFlowContext_FatalWriteError(t *testing.T) {
+	src := &sliceSource{messages: []string{"a"}}
+	boom := errors.New("boom")
+	dest := &memoryDestination{err: Fatal(boom)}
+
+	err := FlowContext(context.Background(), src, nil, dest)
+
+	assert.True(t, errors.Is(err, boom))
+}
+
+func TestPipeline_Drain(t *testing.T) {
+	src := &sliceSource{messages: []string{"a", "b", "c", "d"}}
+	dest := &memoryDestination{delay: 50 * time.Millisecond}
+	p := &Pipeline{Source: src, Destination: dest}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+
+	// cancel while "a" is being written
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	// "b" and "c" were already read by the dispatcher and the message
+	// adapter when the source was stopped, "d" was never read
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"a", "b", "c"}, dest.written())
+}
+
+func TestPipeline_DrainTimeout(t *testing.T) {
+	src := &sliceSource{messages: []string{"a"}}
+	dest := &memoryDestination{delay: time.Second}
+	p := &Pipeline{Source: src, Destination: dest, DrainTimeout: 50 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	err := <-done
+	assert.True(t, errors.Is(err, ErrDrainTimeout))
+	assert.Contains(t, err.Error(), "1 messages lost")
+}
+
+// openSource is a sliceSource that never closes its channel, even
+// once disconnected.
+type openSource struct {
+	sliceSource
+}
+
+func (s *openSource) Read() (chan string, error) {
+	channel := make(chan string)
+	go func() {
+		for _, m := range s.messages {
+			channel <- m
+		}
+	}()
+	return channel, nil
+}
+
+func TestPipeline_DrainOpenSource(t *testing.T) {
+	src := &openSource{sliceSource{messages: []string{"a"}}}
+	dest := &memoryDestination{}
+	p := &Pipeline{Source: src, Destination: dest, DrainTimeout: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	// the drain doesn't wait for the channel to be closed
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	assert.Equal(t, []string{"a"}, dest.written())
+}
+
+// ackSource emits messages that record whether they were acked
+// or nacked.
+type ackSource struct {
+	sliceSource
+	mu     sync.Mutex
+	acked  []string
+	nacked []string
+}
+
+func (s *ackSource) ReadMessages() (chan Message, error) {
+	channel, _ := s.Read()
+	messages := make(chan Message)
+	go func() {
+		defer close(messages)
+		for payload := range channel {
+			payload := payload
+			messages <- NewMessage(payload).WithAcknowledger(ackFuncs{
+				ack: func() error {
+					s.mu.Lock()
+					defer s.mu.Unlock()
+					s.acked = append(s.acked, payload)
+					return nil
+				},
+				nack: func(err error) error {
+					s.mu.Lock()
+					defer s.mu.Unlock()
+					s.nacked = append(s.nacked, payload)
+					return nil
+				},
+			})
+		}
+	}()
+	return messages, nil
+}
+
+func TestPipeline_Ack(t *testing.T) {
+	src := &ackSource{sliceSource: sliceSource{messages: []string{"a", "b"}, close: true}}
+	dest := &memoryDestination{}
+
+	err := FlowContext(context.Background(), src, nil, dest)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, src.acked)
+	assert.Empty(t, src.nacked)
+}
+
+func TestPipeline_Nack(t *testing.T) {
+	src := &ackSource{sliceSource: sliceSource{messages: []string{"a", "b"}, close: true}}
+	dest := &memoryDestination{err: errors.New("unavailable")}
+
+	err := FlowContext(context.Background(), src, nil, dest)
+
+	assert.NoError(t, err)
+	assert.Empty(t, src.acked)
+	assert.Equal(t, []string{"a", "b"}, src.nacked)
+}
+
+// upperTransformer upper-cases payloads and fails on "bad".
+type upperTransformer struct{}
+
+func (upperTransformer) Transform(message string) (string, error) {
+	if message == "bad" {
+		return "", errors.New("bad message")
+	}
+	return strings.ToUpper(message), nil
+}
+
+func (upperTransformer) Info() {}
+
+func TestPipeline_DeadLetter(t *testing.T) {
+	src := &ackSource{sliceSource: sliceSource{messages: []string{"a", "bad"}, close: true}}
+	dest := &memoryDestination{}
+	dlq := &memoryDestination{}
+	p := &Pipeline{Source: src, Transformer: upperTransformer{}, Destination: dest, DeadLetter: dlq}
+
+	assert.NoError(t, p.Run(context.Background()))
+
+	assert.Equal(t, []string{"A"}, dest.written())
+	assert.Equal(t, []string{"a", "bad"}, src.acked)
+	if assert.Len(t, dlq.written(), 1) {
+		var letter DeadLetter
+		assert.Contains(t, dlq.written()[0], `"payload":"YmFk"`)
+		assert.NoError(t, json.Unmarshal([]byte(dlq.written()[0]), &letter))
+		assert.Equal(t, []byte("bad"), letter.Payload)
+		assert.Equal(t, StageTransform, letter.Stage)
+		assert.Equal(t, "bad message", letter.Error)
+		assert.Equal(t, 1, letter.Attempts)
+	}
+}
+
+func TestPipeline_DeadLetterWrite(t *testing.T) {
+	src := &ackSource{sliceSource: sliceSource{messages: []string{"a"}, close: true}}
+	dest := &memoryDestination{err: errors.New("unavailable")}
+	dlq := &memoryDestination{}
+	p := &Pipeline{Source: src, Transformer: upperTransformer{}, Destination: dest, DeadLetter: dlq}
+
+	assert.NoError(t, p.Run(context.Background()))
+
+	assert.Equal(t, []string{"a"}, src.acked)
+	if assert.Len(t, dlq.written(), 1) {
+		var letter DeadLetter
+		assert.NoError(t, json.Unmarshal([]byte(dlq.written()[0]), &letter))
+		assert.Equal(t, []byte("a"), letter.Payload)
+		assert.Equal(t, StageWrite, letter.Stage)
+	}
+}
+
+// keyedSource emits messages keyed by the first character of their
+// payload.
+type keyedSource struct {
+	sliceSource
+}
+
+func (s *keyedSource) ReadMessages() (chan Message, error) {
+	channel, _ := s.Read()
+	messages := make(chan Message)
+	go func() {
+		defer close(messages)
+		for payload := range channel {
+			message := NewMessage(payload)
+			message.Key = payload[:1]
+			messages <- message
+		}
+	}()
+	return messages, nil
+}
+
+// concurrentDestination records the maximum number of concurrent
+// writes.
+type concurrentDestination struct {
+	memoryDestination
+	inFlight, max int32
+}
+
+func (d *concurrentDestination) Write(message string) error {
+	n := atomic.AddInt32(&d.inFlight, 1)
+	defer atomic.AddInt32(&d.inFlight, -1)
+	for {
+		m := atomic.LoadInt32(&d.max)
+		if n <= m || atomic.CompareAndSwapInt32(&d.max, m, n) {
+			break
+		}
+	}
+	return d.memoryDestination.Write(message)
+}
+
+func TestPipeline_Workers(t *testing.T) {
+	var payloads []string
+	for i := 0; i < 20; i++ {
+		payloads = append(payloads, fmt.Sprintf("%c%02d", 'a'+i%4, i))
+	}
+	src := &keyedSource{sliceSource{messages: payloads, close: true}}
+	dest := &concurrentDestination{memoryDestination: memoryDestination{delay: 10 * time.Millisecond}}
+	p := &Pipeline{Source: src, Destination: dest, Workers: 4, OrderByKey: true}
+
+	assert.NoError(t, p.Run(context.Background()))
+
+	assert.Greater(t, atomic.LoadInt32(&dest.max), int32(1))
+	assert.LessOrEqual(t, atomic.LoadInt32(&dest.max), int32(4))
+	assert.Len(t, dest.written(), 20)
+
+	// messages with the same key keep their order
+	last := map[byte]string{}
+	for _, m := range dest.written() {
+		assert.Less(t, last[m[0]], m)
+		last[m[0]] = m
+	}
+}
@@ -1,32 +1,115 @@
 package stream
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
 
 type RabbitMQ struct {
-	URL     string
-	Header  http.Header
-	Args    map[string]string
-	conn    *amqp.Connection
-	channel *amqp.Channel
+	URL         string
+	Header      http.Header
+	Args        map[string]string
+	Retry       *RetryPolicy // overrides Pipeline.Retry if set
+	conn        *amqp.Connection
+	channel     *amqp.Channel
+	consumerTag string        // tag of the active consumer, set by Read
+	done        chan struct{} // closed on Disconnect
+	health      healthState
+}
+
+// openRabbitMQ returns a RabbitMQ for an amqp:// or amqps:// URI
+// whose query parameters are its Args.
+func openRabbitMQ(u *url.URL) (r *RabbitMQ, err error) {
+	r = &RabbitMQ{}
+	r.Args, err = setFields(r, query(u))
+	if err != nil {
+		return nil, err
+	}
+	conn := *u
+	conn.RawQuery = ""
+	r.URL = conn.String()
+	return
+}
+
+var rabbitMQOptions = Options{
+	{Name: "exchange", Type: StringOption, Required: true, Usage: DestinationOnly, Description: "exchange to publish to"},
+	{Name: "key", Type: StringOption, Usage: DestinationOnly, Description: "routing key"},
+	{Name: "keyFromMessage", Type: BoolOption, Default: "false", Usage: DestinationOnly, Description: "route messages that have a key with it instead of `key`"},
+	{Name: "queue", Type: StringOption, Required: true, Usage: SourceOnly, Description: "queue to consume from"},
+	{Name: "consumer", Type: StringOption, Usage: SourceOnly, Description: "consumer tag, generated if empty"},
+	{Name: "autoAck", Type: BoolOption, Default: "false", Usage: SourceOnly, Description: "let the server consider deliveries acked as soon as they are sent"},
+	{Name: "prefetch", Type: IntOption, Usage: SourceOnly, Description: "maximum number of unacked deliveries"},
+}
+
+// Options returns the Args RabbitMQ accepts.
+func (r *RabbitMQ) Options() Options {
+	return rabbitMQOptions
+}
+
+// RetryPolicy returns Retry, see Retrier.
+func (r *RabbitMQ) RetryPolicy() *RetryPolicy {
+	return r.Retry
 }
 
 func (r *RabbitMQ) Connect() (err error) {
+	err = rabbitMQOptions.Validate(r.Args, SourceAndDestination)
+	if err != nil {
+		return fmt.Errorf("RabbitMQ: %w", err)
+	}
+
 	// connect to rabbitmq
 	log.Info("Establishing rabbitmq connection...")
 	r.conn, err = amqp.Dial(r.URL)
 	if err != nil {
 		log.Error("RabbitMQ: Failed to connect: ", err)
+		r.health.connected(err)
 		return
 	}
 	r.channel, err = r.conn.Channel()
 	if err != nil {
 		log.Error("RabbitMQ: Failed to open a channel: ", err)
 	}
+	r.done = make(chan struct{})
+	r.health.connected(err)
+
+	// report connections closed by the server or the network
+	closed := r.conn.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if e, ok := <-closed; ok && e != nil {
+			log.Error("RabbitMQ: Connection closed: ", e)
+			r.health.connected(e)
+		}
+	}()
+	return
+}
+
+// Health reports whether the connection is open and when a message
+// was last consumed or published.
+func (r *RabbitMQ) Health() Health {
+	return r.health.get()
+}
+
+// Stop cancels the consumer started by Read. Deliveries already
+// received from the server are still pushed into the read channel
+// before it is closed.
+func (r *RabbitMQ) Stop() (err error) {
+	if r.channel == nil || r.consumerTag == "" {
+		return
+	}
+
+	log.Info("Cancelling rabbitmq consumer...")
+	err = r.channel.Cancel(r.consumerTag, false)
+	if err != nil {
+		log.Error("RabbitMQ: Failed to cancel consumer: ", err)
+	}
+	r.consumerTag = ""
 	return
 }
 
@@ -36,8 +119,15 @@ func (r *RabbitMQ) Disconnect() (err error) {
 		return
 	}
 
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+
 	log.Info("Closing rabbitmq connection...")
+	r.health.disconnected()
 	err = r.conn.Close()
+	r.conn = nil
 	if err != nil {
 		log.Error("RabbitMQ close error: ", err)
 		return
@@ -54,31 +144,109 @@ func (r *RabbitMQ) Disconnect() (err error) {
 //  key - routing key
 //  message - message to publish
 func (r *RabbitMQ) Write(message string) (err error) {
+	return r.WriteMessage(NewMessage(message))
+}
+
+// WriteMessage publishes `message` like Write, with its headers as
+// AMQP headers. With `keyFromMessage`, the key of `message` (if set)
+// is the routing key instead of `key`.
+func (r *RabbitMQ) WriteMessage(message Message) (err error) {
+	key := r.Args["key"]
+	if message.Key != "" && rabbitMQOptions.Bool(r.Args, "keyFromMessage") {
+		key = message.Key
+	}
+
+	var headers amqp.Table
+	if len(message.Headers) > 0 {
+		headers = amqp.Table{}
+		for k, v := range message.Headers {
+			headers[k] = v
+		}
+	}
+
+	contentType := "text/plain"
+	if val, ok := message.Metadata["contentType"]; ok {
+		contentType = val
+	}
+
 	err = r.channel.Publish(
 		r.Args["exchange"], // exchange
-		r.Args["key"],      // routing key
+		key,                // routing key
 		false,              // mandatory
 		false,              // immediate
 		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(message),
+			Headers:     headers,
+			ContentType: contentType,
+			Timestamp:   message.Timestamp,
+			Body:        message.Payload,
 		})
 
 	if err != nil {
 		log.Error("RabbitMQ: Failed to publish to channel: ", err)
+		err = amqpError(err)
 		return
 	}
+	r.health.wrote()
 
 	return
 }
 
+// amqpError marks errors that retrying won't fix, such as a missing
+// exchange or refused access, as permanent.
+func amqpError(err error) error {
+	if e, ok := err.(*amqp.Error); ok {
+		switch e.Code {
+		case amqp.NotFound, amqp.AccessRefused, amqp.PreconditionFailed, amqp.ContentTooLarge:
+			return Permanent(err)
+		}
+	}
+	return err
+}
+
+// Read consumes from a RabbitMQ queue.
+//
+// Key Arguments:
+//  queue - queue to consume from
+//  consumer - consumer tag, generated if empty
+//  autoAck - "true" to let the server consider deliveries acked as
+//            soon as they are sent (defaults to "false")
+//  prefetch - maximum number of unacked deliveries
+//
+// Deliveries read with Read are acked once pushed into the channel.
 func (r *RabbitMQ) Read() (channel chan string, err error) {
-	channel = make(chan string)
+	messages, err := r.ReadMessages()
+	if err != nil {
+		return
+	}
+	return payloads(messages), nil
+}
+
+// ReadMessages is like Read but keeps the routing key, headers,
+// timestamp and delivery tag of each delivery.
+//
+// Unless `autoAck` is set, acking a message acks its delivery and
+// nacking it requeues the delivery so that it is redelivered.
+func (r *RabbitMQ) ReadMessages() (channel chan Message, err error) {
+	channel = make(chan Message)
+
+	r.consumerTag = r.Args["consumer"]
+	if r.consumerTag == "" {
+		r.consumerTag = fmt.Sprintf("manifold-%d-%d", os.Getpid(), time.Now().UnixNano())
+	}
+
+	autoAck := rabbitMQOptions.Bool(r.Args, "autoAck")
+	if _, ok := r.Args["prefetch"]; ok {
+		err = r.channel.Qos(rabbitMQOptions.Int(r.Args, "prefetch"), 0, false)
+		if err != nil {
+			log.Error("RabbitMQ: Failed to set prefetch: ", err)
+			return nil, err
+		}
+	}
 
 	deliveryChannel, err := r.channel.Consume(
 		r.Args["queue"],
-		r.Args["consumer"],
-		true,
+		r.consumerTag,
+		autoAck,
 		false,
 		false,
 		false,
@@ -89,15 +257,74 @@ func (r *RabbitMQ) Read() (channel chan string, err error) {
 		return
 	}
 
+	done, conn := r.done, r.conn
 	go func() {
+		defer close(channel)
+		// the connection was lost, not only the consumer cancelled
+		defer func() {
+			if conn.IsClosed() {
+				r.health.connected(amqp.ErrClosed)
+			}
+		}()
 		for m := range deliveryChannel {
-			channel <- string(m.Body)
+			r.health.read()
+			message := deliveryMessage(m)
+			if !autoAck {
+				message = message.WithAcknowledger(deliveryAcker(m))
+			}
+
+			select {
+			case channel <- message:
+			case <-done:
+				return
+			}
 		}
 	}()
 
 	return
 }
 
+// deliveryAcker acks `d` or requeues it when nacked, unless the
+// error is permanent: it would fail again, so `d` is rejected and
+// goes to the queue's dead-letter exchange if it has one.
+func deliveryAcker(d amqp.Delivery) Acknowledger {
+	return ackFuncs{
+		ack: func() error {
+			return d.Ack(false)
+		},
+		nack: func(err error) error {
+			return d.Nack(false, !IsPermanent(err))
+		},
+	}
+}
+
+// deliveryMessage converts an AMQP delivery into a message.
+func deliveryMessage(d amqp.Delivery) Message {
+	headers := map[string]string{}
+	for k, v := range d.Headers {
+		headers[k] = fmt.Sprint(v)
+	}
+
+	timestamp := d.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	return Message{
+		Payload:   d.Body,
+		Key:       d.RoutingKey,
+		Headers:   headers,
+		Timestamp: timestamp,
+		Offset:    strconv.FormatUint(d.DeliveryTag, 10),
+		Metadata: map[string]string{
+			"exchange":    d.Exchange,
+			"contentType": d.ContentType,
+			"messageId":   d.MessageId,
+			"redelivered": strconv.FormatBool(d.Redelivered),
+		},
+	}
+}
+
 func (r *RabbitMQ) Info() {
 	log.Info("Args: ", r.Args)
 }
@@ -0,0 +1,35 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// requeueRecorder records whether nacked deliveries were requeued.
+type requeueRecorder struct {
+	requeued []bool
+}
+
+func (r *requeueRecorder) Ack(tag uint64, multiple bool) error { return nil }
+func (r *requeueRecorder) Reject(tag uint64, requeue bool) error {
+	r.requeued = append(r.requeued, requeue)
+	return nil
+}
+func (r *requeueRecorder) Nack(tag uint64, multiple bool, requeue bool) error {
+	r.requeued = append(r.requeued, requeue)
+	return nil
+}
+
+func TestRabbitMQ_NackRequeue(t *testing.T) {
+	r := &requeueRecorder{}
+	acker := deliveryAcker(amqp.Delivery{Acknowledger: r})
+
+	assert.NoError(t, acker.Nack(errors.New("unavailable")))
+	assert.NoError(t, acker.Nack(Permanent(errors.New("invalid"))))
+	assert.NoError(t, acker.Nack(Fatal(errors.New("gone"))))
+
+	assert.Equal(t, []bool{true, false, false}, r.requeued)
+}
@@ -0,0 +1,180 @@
+package stream
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStream_WriteAndRead(t *testing.T) {
+	s := miniredis.RunT(t)
+	url := "redis://" + s.Addr()
+
+	dest := &RedisStream{URL: url, Stream: "events", Args: map[string]string{"maxLen": "2", "approx": "false"}}
+	if !assert.NoError(t, dest.Connect()) {
+		return
+	}
+	defer dest.Disconnect()
+	assert.NoError(t, dest.Write("dropped"))
+	assert.NoError(t, dest.WriteBatch([]Message{
+		{Payload: []byte("a"), Headers: map[string]string{"h": "1"}},
+		{Payload: []byte("b")},
+	}))
+	entries, _ := s.Stream("events")
+	assert.Len(t, entries, 2)
+
+	src := &RedisStream{URL: url, Stream: "events", Group: "g", Consumer: "c1", Args: map[string]string{"startId": "0", "block": "50ms"}}
+	if !assert.NoError(t, src.Connect()) {
+		return
+	}
+	defer src.Disconnect()
+	channel, err := src.ReadMessages()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	a, b := receive(t, channel), receive(t, channel)
+	assert.Equal(t, "a", a.String())
+	assert.Equal(t, map[string]string{"h": "1"}, a.Headers)
+	assert.Equal(t, entries[0].ID, a.Offset)
+	assert.Equal(t, "false", a.Metadata["claimed"])
+	assert.Equal(t, 2, src.Health().Backlog)
+
+	// acked entries are no longer pending, nacked ones are
+	a.Ack()
+	b.Nack(nil)
+	assert.Equal(t, 0, src.Health().Backlog)
+	pending, err := redisClient(s).XPending(context.Background(), "events", "g").Result()
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), pending.Count)
+	}
+
+	// stopping closes the channel
+	assert.NoError(t, src.Stop())
+	for range channel {
+	}
+
+	// pending entries of the consumer are read again first
+	channel, err = src.ReadMessages()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "b", receive(t, channel).String())
+	}
+}
+
+func TestRedisStream_ClaimsStaleEntries(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redisClient(s)
+	ctx := context.Background()
+	client.XGroupCreateMkStream(ctx, "events", "g", "0")
+	client.XAdd(ctx, &redis.XAddArgs{Stream: "events", Values: []interface{}{"payload", "orphan"}})
+
+	// a consumer that dies before acking
+	_, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "g", Consumer: "dead", Streams: []string{"events", ">"}}).Result()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	src := &RedisStream{URL: "redis://" + s.Addr(), Stream: "events", Group: "g", Consumer: "alive", Args: map[string]string{
+		"claimIdle":  "50ms",
+		"claimEvery": "50ms",
+		"block":      "50ms",
+	}}
+	if !assert.NoError(t, src.Connect()) {
+		return
+	}
+	defer src.Disconnect()
+	channel, err := src.ReadMessages()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	message := receive(t, channel)
+	assert.Equal(t, "orphan", message.String())
+	assert.Equal(t, "true", message.Metadata["claimed"])
+	message.Ack()
+	pending, _ := client.XPending(ctx, "events", "g").Result()
+	assert.Equal(t, int64(0), pending.Count)
+}
+
+func TestRedisStream_DoesNotClaimInFlightEntries(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redisClient(s)
+	ctx := context.Background()
+	client.XAdd(ctx, &redis.XAddArgs{Stream: "events", Values: []interface{}{"payload", "slow"}})
+
+	src := &RedisStream{URL: "redis://" + s.Addr(), Stream: "events", Group: "g", Consumer: "c1", Args: map[string]string{
+		"startId":    "0",
+		"claimIdle":  "20ms",
+		"claimEvery": "20ms",
+		"block":      "20ms",
+	}}
+	if !assert.NoError(t, src.Connect()) {
+		return
+	}
+	defer src.Disconnect()
+	channel, err := src.ReadMessages()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	message := receive(t, channel)
+	assert.Equal(t, "false", message.Metadata["claimed"])
+
+	// the entry stays pending while it is written
+	select {
+	case m := <-channel:
+		t.Fatalf("claimed an entry in flight: %s", m.String())
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// once nacked it is claimed again
+	message.Nack(nil)
+	message = receive(t, channel)
+	assert.Equal(t, "slow", message.String())
+	assert.Equal(t, "true", message.Metadata["claimed"])
+}
+
+func TestRedisStream_HeaderNamedLikeField(t *testing.T) {
+	s := miniredis.RunT(t)
+	dest := &RedisStream{URL: "redis://" + s.Addr(), Stream: "events"}
+	if !assert.NoError(t, dest.Connect()) {
+		return
+	}
+	defer dest.Disconnect()
+	assert.NoError(t, dest.WriteMessage(Message{Payload: []byte("a"), Headers: map[string]string{"payload": "b", "h": "1"}}))
+
+	entries, _ := s.Stream("events")
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, []string{"payload", "a", "h", "1"}, entries[0].Values)
+	}
+}
+
+func TestRedisStream_ReadWithoutGroup(t *testing.T) {
+	s := miniredis.RunT(t)
+	src := &RedisStream{URL: "redis://" + s.Addr(), Stream: "events"}
+	if assert.NoError(t, src.Connect()) {
+		_, err := src.ReadMessages()
+		assert.True(t, IsFatal(err))
+		src.Disconnect()
+	}
+}
+
+func TestOpenRedisStream(t *testing.T) {
+	u, _ := url.Parse("rediss://:secret@host:6380/events?group=g&db=2")
+	r, err := openRedisStream(u)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "rediss://:secret@host:6380", r.URL)
+		assert.Equal(t, "events", r.Stream)
+		assert.Equal(t, "g", r.Group)
+		assert.Equal(t, map[string]string{"db": "2"}, r.Args)
+	}
+}
+
+func redisClient(s *miniredis.Miniredis) *redis.Client {
+	return redis.NewClient(&redis.Options{Addr: s.Addr()})
+}
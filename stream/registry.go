@@ -0,0 +1,206 @@
+package stream
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SourceOpener builds a source from a URI.
+type SourceOpener func(u *url.URL) (Source, error)
+
+// DestinationOpener builds a destination from a URI.
+type DestinationOpener func(u *url.URL) (Destination, error)
+
+var registry = struct {
+	mu           sync.RWMutex
+	sources      map[string]SourceOpener
+	destinations map[string]DestinationOpener
+}{
+	sources:      map[string]SourceOpener{},
+	destinations: map[string]DestinationOpener{},
+}
+
+// RegisterSource makes OpenSource use `open` for URIs with `scheme`,
+// replacing any opener registered for it before.
+//
+// Example:
+//  func init() {
+//      stream.RegisterSource("ftp", func(u *url.URL) (stream.Source, error) {
+//          return &FTP{Host: u.Host, Path: u.Path}, nil
+//      })
+//  }
+func RegisterSource(scheme string, open SourceOpener) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.sources[scheme] = open
+}
+
+// RegisterDestination makes OpenDestination use `open` for URIs with
+// `scheme`, replacing any opener registered for it before.
+func RegisterDestination(scheme string, open DestinationOpener) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.destinations[scheme] = open
+}
+
+// OpenSource returns the source described by `uri`, built by the
+// opener registered for its scheme. Built-in schemes are:
+//  amqp://user:pw@host/vhost?queue=q
+//  ws://host/path?reconnect_every=1h
+//  http://0.0.0.0:8080/webhook?hmacHeader=X-Signature&hmacSecret=s
+//  kinesis://stream?shard=shardId-000000000000&shardIterator=LATEST&region=us-east-1
+//  kafka://broker1:9092,broker2:9092/topic?groupId=g&startOffset=oldest
+//  nats://host:4222/subject?jetstream=true&durable=d
+//  mqtt://user:pw@host:1883/sensors/+/temperature?qos=1
+//  redis://:pw@host:6379/stream?group=g&consumer=c
+//  stdio://
+//
+// Query parameters set the struct members of the same name, ignoring
+// case, or become Args otherwise.
+func OpenSource(uri string) (Source, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	registry.mu.RLock()
+	open, ok := registry.sources[u.Scheme]
+	registry.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no source registered for scheme %q, expected one of %s", u.Scheme, strings.Join(SourceSchemes(), ", "))
+	}
+	return open(u)
+}
+
+// OpenDestination is like OpenSource for destinations. Built-in
+// schemes also include:
+//  kinesis://stream?partitionKey=p1&region=us-east-1
+//  https://host/path?method=PUT&timeout=10s
+//  s3://bucket/folder?commitFileSize=1024&uploadEvery=60&region=us-east-1
+func OpenDestination(uri string) (Destination, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	registry.mu.RLock()
+	open, ok := registry.destinations[u.Scheme]
+	registry.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no destination registered for scheme %q, expected one of %s", u.Scheme, strings.Join(DestinationSchemes(), ", "))
+	}
+	return open(u)
+}
+
+// SourceSchemes returns the schemes sources are registered for.
+func SourceSchemes() (schemes []string) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	for scheme := range registry.sources {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return
+}
+
+// DestinationSchemes returns the schemes destinations are registered
+// for.
+func DestinationSchemes() (schemes []string) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	for scheme := range registry.destinations {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return
+}
+
+func init() {
+	for _, scheme := range []string{"amqp", "amqps"} {
+		RegisterSource(scheme, func(u *url.URL) (Source, error) { return openRabbitMQ(u) })
+		RegisterDestination(scheme, func(u *url.URL) (Destination, error) { return openRabbitMQ(u) })
+	}
+	for _, scheme := range []string{"ws", "wss"} {
+		RegisterSource(scheme, func(u *url.URL) (Source, error) { return openWebSocket(u) })
+		RegisterDestination(scheme, func(u *url.URL) (Destination, error) { return openWebSocket(u) })
+	}
+	for _, scheme := range []string{"http", "https"} {
+		RegisterSource(scheme, func(u *url.URL) (Source, error) { return openHTTPServer(u) })
+		RegisterDestination(scheme, func(u *url.URL) (Destination, error) { return openHTTP(u) })
+	}
+	RegisterSource("kinesis", func(u *url.URL) (Source, error) { return openKinesis(u) })
+	RegisterDestination("kinesis", func(u *url.URL) (Destination, error) { return openKinesis(u) })
+	RegisterSource("kafka", func(u *url.URL) (Source, error) { return openKafka(u) })
+	RegisterDestination("kafka", func(u *url.URL) (Destination, error) { return openKafka(u) })
+	for _, scheme := range []string{"mqtt", "mqtts"} {
+		RegisterSource(scheme, func(u *url.URL) (Source, error) { return openMQTT(u) })
+		RegisterDestination(scheme, func(u *url.URL) (Destination, error) { return openMQTT(u) })
+	}
+	RegisterSource("nats", func(u *url.URL) (Source, error) { return openNATS(u) })
+	RegisterDestination("nats", func(u *url.URL) (Destination, error) { return openNATS(u) })
+	for _, scheme := range []string{"redis", "rediss"} {
+		RegisterSource(scheme, func(u *url.URL) (Source, error) { return openRedisStream(u) })
+		RegisterDestination(scheme, func(u *url.URL) (Destination, error) { return openRedisStream(u) })
+	}
+	RegisterDestination("s3", func(u *url.URL) (Destination, error) { return openS3(u) })
+	RegisterSource("stdio", func(u *url.URL) (Source, error) { return &Stdio{}, nil })
+	RegisterDestination("stdio", func(u *url.URL) (Destination, error) { return &Stdio{}, nil })
+}
+
+// query returns the query parameters of `u`, keeping the first
+// value of each.
+func query(u *url.URL) map[string]string {
+	params := map[string]string{}
+	for key, values := range u.Query() {
+		params[key] = values[0]
+	}
+	return params
+}
+
+// setFields sets the string, int, bool and duration fields of the
+// struct pointed to by `v` from the parameters whose names match
+// theirs, ignoring case, and returns the other parameters. Durations
+// are parsed like options, so plain integers are nanoseconds.
+func setFields(v interface{}, params map[string]string) (args map[string]string, err error) {
+	args = map[string]string{}
+	s := reflect.ValueOf(v).Elem()
+	for key, value := range params {
+		field := s.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, key)
+		})
+		if !field.IsValid() || !field.CanSet() {
+			args[key] = value
+			continue
+		}
+
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(value)
+		case int:
+			n, e := strconv.Atoi(value)
+			if e != nil {
+				return nil, fmt.Errorf("%s is not an integer: %q", key, value)
+			}
+			field.SetInt(int64(n))
+		case bool:
+			b, e := strconv.ParseBool(value)
+			if e != nil {
+				return nil, fmt.Errorf("%s is not a boolean: %q", key, value)
+			}
+			field.SetBool(b)
+		case time.Duration:
+			d, e := parseDuration(value)
+			if e != nil {
+				return nil, fmt.Errorf("%s is not a duration: %q", key, value)
+			}
+			field.SetInt(int64(d))
+		default:
+			args[key] = value
+		}
+	}
+	return
+}
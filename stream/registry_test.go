@@ -0,0 +1,128 @@
+package stream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenSource_RabbitMQ(t *testing.T) {
+	src, err := OpenSource("amqp://user:pw@localhost:5672/vhost?queue=q&prefetch=10")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &RabbitMQ{
+			URL:  "amqp://user:pw@localhost:5672/vhost",
+			Args: map[string]string{"queue": "q", "prefetch": "10"},
+		}, src)
+	}
+}
+
+func TestOpenSource_WebSocket(t *testing.T) {
+	src, err := OpenSource("wss://example.com/feed?token=t&reconnect_every=1h")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "wss://example.com/feed?token=t", src.(*WebSocket).URL)
+		assert.Equal(t, map[string]string{"reconnect_every": "1h"}, src.(*WebSocket).Args)
+	}
+}
+
+func TestOpenSource_Kinesis(t *testing.T) {
+	// answers DescribeStreamSummary
+	var target string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.Header.Get("X-Amz-Target")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"StreamDescriptionSummary":{"StreamARN":"arn:aws:kinesis:us-east-1:123:stream/events"}}`))
+	}))
+	defer server.Close()
+
+	src, err := OpenSource("kinesis://events?shard=shardId-0&shardIterator=LATEST&region=us-east-1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	k := src.(*Kinesis)
+	assert.Equal(t, "us-east-1", *k.AWSSess.Config.Region)
+	assert.Equal(t, map[string]string{"streamName": "events", "shardId": "shardId-0", "shardIterator": "LATEST"}, k.Args)
+
+	k.AWSSess.Config.Endpoint = aws.String(server.URL)
+	k.AWSSess.Config.Credentials = credentials.NewStaticCredentials("id", "secret", "")
+	if !assert.NoError(t, k.Connect()) {
+		return
+	}
+	if assert.NoError(t, k.resolveConsumer("shardId-0")) {
+		assert.Equal(t, "Kinesis_20131202.DescribeStreamSummary", target)
+		assert.Equal(t, "arn:aws:kinesis:us-east-1:123:stream/events", k.StreamARN)
+		assert.True(t, strings.HasPrefix(k.ConsumerName, "manifold-"))
+		assert.True(t, strings.HasSuffix(k.ConsumerName, "-shardId-0"))
+	}
+
+	src, err = OpenSource("kinesis://events?arn=arn:aws:kinesis:us-east-1:123:stream/events&consumerName=c&shard=shardId-0&shardIterator=LATEST")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "arn:aws:kinesis:us-east-1:123:stream/events", src.(*Kinesis).StreamARN)
+		assert.Equal(t, "c", src.(*Kinesis).ConsumerName)
+	}
+}
+
+func TestOpenSource_NATS(t *testing.T) {
+	src, err := OpenSource("nats://localhost:4222/events.>?jetstream=true&durable=d")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &NATS{
+			URL:     "nats://localhost:4222",
+			Subject: "events.>",
+			Args:    map[string]string{"jetstream": "true", "durable": "d"},
+		}, src)
+	}
+}
+
+func TestOpenDestination_S3(t *testing.T) {
+	dest, err := OpenDestination("s3://bucket/some/folder?commitFileSize=1024&uploadEvery=60&region=eu-west-1&bufferPath=/tmp/b")
+	if assert.NoError(t, err) {
+		s := dest.(*S3)
+		assert.Equal(t, "bucket", s.BucketName)
+		assert.Equal(t, "eu-west-1", s.Region)
+		assert.Equal(t, &S3Config{Folder: "some/folder", CommitFileSize: 1024, UploadEvery: 60}, s.Config)
+		assert.Equal(t, map[string]string{"bufferPath": "/tmp/b"}, s.Args)
+	}
+
+	_, err = OpenDestination("s3://bucket?commitFileSize=big")
+	assert.EqualError(t, err, `commitFileSize is not an integer: "big"`)
+}
+
+func TestSetFields_Duration(t *testing.T) {
+	var v struct {
+		Timeout  time.Duration
+		Interval time.Duration
+	}
+	args, err := setFields(&v, map[string]string{"timeout": "1500", "interval": "2s"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1500*time.Nanosecond, v.Timeout)
+		assert.Equal(t, 2*time.Second, v.Interval)
+		assert.Empty(t, args)
+	}
+
+	_, err = setFields(&v, map[string]string{"timeout": "soon"})
+	assert.EqualError(t, err, `timeout is not a duration: "soon"`)
+}
+
+func TestOpen_Unknown(t *testing.T) {
+	_, err := OpenSource("s3://bucket")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `no source registered for scheme "s3", expected one of `+strings.Join(SourceSchemes(), ", "))
+		assert.NotContains(t, SourceSchemes(), "s3")
+	}
+}
+
+func TestRegisterSource(t *testing.T) {
+	RegisterSource("slice", func(u *url.URL) (Source, error) {
+		return &sliceSource{messages: []string{u.Host}}, nil
+	})
+	src, err := OpenSource("slice://a")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a"}, src.(*sliceSource).messages)
+	}
+}
@@ -0,0 +1,119 @@
+package stream
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryPolicy retries a failing operation with exponential backoff.
+//
+// The wait after the first failure is `InitialInterval`, each
+// following wait is `Multiplier` times longer, capped at
+// `MaxInterval`, and randomized by ±`Jitter` (0 to 1). Retrying
+// stops after `MaxAttempts` attempts or once `MaxElapsedTime` has
+// passed since the first attempt; 0 means no limit.
+//
+// Example:
+//  pipeline := stream.Pipeline{
+//      ...
+//      Retry: &stream.RetryPolicy{
+//          MaxAttempts:     5,
+//          InitialInterval: 100 * time.Millisecond,
+//          MaxInterval:     10 * time.Second,
+//          Multiplier:      2,
+//          Jitter:          0.2,
+//      },
+//  }
+type RetryPolicy struct {
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	Jitter          float64
+	MaxElapsedTime  time.Duration
+	// Retryable decides whether an error is worth retrying. It
+	// defaults to retrying all errors not marked with Permanent
+	// or Fatal.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy is used by Flow and by MultiDestination targets
+// with the Retry error policy when they don't set a RetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:     5,
+	InitialInterval: 100 * time.Millisecond,
+	MaxInterval:     10 * time.Second,
+	Multiplier:      2,
+	Jitter:          0.2,
+}
+
+// Retrier is implemented by destinations with their own retry
+// policy, which overrides Pipeline.Retry unless it is nil.
+type Retrier interface {
+	RetryPolicy() *RetryPolicy
+}
+
+// Do calls f until it succeeds, fails with an error that isn't
+// retryable, the policy gives up or ctx is done. It returns the
+// number of attempts made and the last error.
+//
+// A nil policy calls f once.
+func (r *RetryPolicy) Do(ctx context.Context, f func() error) (attempts int, err error) {
+	start := time.Now()
+	var interval time.Duration
+	for {
+		attempts++
+		err = f()
+		if err == nil || r == nil || !r.retryable(err) {
+			return
+		}
+		if r.MaxAttempts > 0 && attempts >= r.MaxAttempts {
+			return
+		}
+
+		interval = r.next(interval)
+		wait := r.jitter(interval)
+		if r.MaxElapsedTime > 0 && time.Since(start)+wait > r.MaxElapsedTime {
+			return
+		}
+
+		log.Warnf("Attempt %d failed, retrying in %s: %v", attempts, wait, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (r *RetryPolicy) retryable(err error) bool {
+	if r.Retryable != nil {
+		return r.Retryable(err)
+	}
+	return !IsPermanent(err)
+}
+
+// next returns the interval following `interval`.
+func (r *RetryPolicy) next(interval time.Duration) time.Duration {
+	if interval == 0 {
+		interval = r.InitialInterval
+	} else if r.Multiplier > 0 {
+		interval = time.Duration(float64(interval) * r.Multiplier)
+	}
+	if r.MaxInterval > 0 && interval > r.MaxInterval {
+		interval = r.MaxInterval
+	}
+	return interval
+}
+
+// jitter randomizes `interval` by ±Jitter.
+func (r *RetryPolicy) jitter(interval time.Duration) time.Duration {
+	if r.Jitter <= 0 {
+		return interval
+	}
+	delta := r.Jitter * float64(interval)
+	return time.Duration(float64(interval) - delta + rand.Float64()*2*delta)
+}
@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy_Do(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 5, InitialInterval: time.Millisecond, Multiplier: 2}
+
+	calls := 0
+	attempts, err := policy.Do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetryPolicy_DoPermanent(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 5, InitialInterval: time.Millisecond}
+
+	attempts, err := policy.Do(context.Background(), func() error {
+		return Permanent(errors.New("invalid"))
+	})
+
+	assert.True(t, IsPermanent(err))
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryPolicy_DoMaxAttempts(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond}
+
+	attempts, err := policy.Do(context.Background(), func() error {
+		return errors.New("transient")
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetryPolicy_Next(t *testing.T) {
+	policy := &RetryPolicy{InitialInterval: time.Second, Multiplier: 2, MaxInterval: 3 * time.Second}
+
+	interval := policy.next(0)
+	assert.Equal(t, time.Second, interval)
+	interval = policy.next(interval)
+	assert.Equal(t, 2*time.Second, interval)
+	interval = policy.next(interval)
+	assert.Equal(t, 3*time.Second, interval)
+}
+
+func TestPipeline_Retry(t *testing.T) {
+	src := &ackSource{sliceSource: sliceSource{messages: []string{"a"}, close: true}}
+	dest := &flakyDestination{failures: 2}
+	p := &Pipeline{
+		Source:      src,
+		Destination: dest,
+		Retry:       &RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond},
+	}
+
+	assert.NoError(t, p.Run(context.Background()))
+	assert.Equal(t, []string{"a"}, dest.written())
+	assert.Equal(t, []string{"a"}, src.acked)
+}
+
+// retrierDestination is a flakyDestination with its own retry policy.
+type retrierDestination struct {
+	flakyDestination
+	policy *RetryPolicy
+}
+
+func (d *retrierDestination) RetryPolicy() *RetryPolicy {
+	return d.policy
+}
+
+func TestPipeline_Retrier(t *testing.T) {
+	// the destination's policy overrides Retry
+	dest := &retrierDestination{flakyDestination: flakyDestination{failures: 2}, policy: &RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond}}
+	p := &Pipeline{
+		Source:      &sliceSource{messages: []string{"a"}, close: true},
+		Destination: dest,
+		Retry:       &RetryPolicy{MaxAttempts: 1},
+	}
+	assert.NoError(t, p.Run(context.Background()))
+	assert.Equal(t, []string{"a"}, dest.written())
+
+	// Retry is used when the destination has no policy
+	dest = &retrierDestination{flakyDestination: flakyDestination{failures: 2}}
+	p = &Pipeline{
+		Source:      &sliceSource{messages: []string{"a"}, close: true},
+		Destination: dest,
+		Retry:       &RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond},
+	}
+	assert.NoError(t, p.Run(context.Background()))
+	assert.Equal(t, []string{"a"}, dest.written())
+}
+
+func TestFlowContext_Retry(t *testing.T) {
+	dest := &flakyDestination{failures: 2}
+
+	err := FlowContext(context.Background(), &sliceSource{messages: []string{"a"}, close: true}, nil, dest)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, dest.written())
+}
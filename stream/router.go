@@ -0,0 +1,343 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Matcher decides whether a message is sent to a route.
+type Matcher interface {
+	Match(message Message) bool
+}
+
+// MatcherFunc adapts a function to a Matcher.
+type MatcherFunc func(message Message) bool
+
+func (f MatcherFunc) Match(message Message) bool {
+	return f(message)
+}
+
+// JSONFieldEquals matches JSON payloads whose field at `path` equals
+// `value`. Path elements are separated by dots, array elements are
+// selected by index, e.g. "items.0.level".
+func JSONFieldEquals(path string, value interface{}) Matcher {
+	// normalize value to what encoding/json decodes, e.g. 1 -> 1.0
+	var expected interface{}
+	if b, err := json.Marshal(value); err == nil {
+		json.Unmarshal(b, &expected)
+	}
+	keys := strings.Split(path, ".")
+
+	return MatcherFunc(func(message Message) bool {
+		var obj interface{}
+		if err := json.Unmarshal(message.Payload, &obj); err != nil {
+			return false
+		}
+		field, ok := jsonField(obj, keys)
+		return ok && reflect.DeepEqual(field, expected)
+	})
+}
+
+// PayloadMatches matches payloads that match the regular expression
+// `re`.
+func PayloadMatches(re *regexp.Regexp) Matcher {
+	return MatcherFunc(func(message Message) bool {
+		return re.Match(message.Payload)
+	})
+}
+
+// HeaderEquals matches messages whose header `key` equals `value`.
+func HeaderEquals(key, value string) Matcher {
+	return MatcherFunc(func(message Message) bool {
+		v, ok := message.Headers[key]
+		return ok && v == value
+	})
+}
+
+// jsonField returns the field of `obj` at `keys`.
+func jsonField(obj interface{}, keys []string) (interface{}, bool) {
+	for _, key := range keys {
+		switch o := obj.(type) {
+		case map[string]interface{}:
+			v, ok := o[key]
+			if !ok {
+				return nil, false
+			}
+			obj = v
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(o) {
+				return nil, false
+			}
+			obj = o[i]
+		default:
+			return nil, false
+		}
+	}
+	return obj, true
+}
+
+// Route sends messages matching `Match` to `Destination`. A route
+// without a matcher matches every message.
+type Route struct {
+	Name        string // defaults to the destination type
+	Match       Matcher
+	Destination Destination
+	stats       RouteStats
+	mu          sync.Mutex // guards stats
+	connected   bool
+}
+
+// RouteStats are the counters of a route.
+type RouteStats struct {
+	Matched uint64 // messages routed to the route
+	Written uint64 // messages written to its destination
+	Failed  uint64 // messages that could not be written
+}
+
+// Router is a destination that sends each message to the first
+// route whose matcher matches it, or to `Default` if none does.
+// Messages matching no route are dropped when there is no default.
+//
+// Example:
+//  dest := stream.Router{
+//      Routes: []*stream.Route{
+//          {Name: "errors", Match: stream.JSONFieldEquals("level", "error"), Destination: &rabbitMQ},
+//      },
+//      Default: &s3,
+//  }
+type Router struct {
+	Routes    []*Route
+	Default   Destination
+	def       *Route
+	unmatched uint64
+	mu        sync.Mutex // guards unmatched
+}
+
+// Connect connects the destinations of all routes that are not
+// connected yet. A destination shared by several routes is connected
+// once.
+func (r *Router) Connect() (err error) {
+	for _, route := range r.routes() {
+		if route.connected {
+			continue
+		}
+		err = route.Destination.Connect()
+		if err != nil {
+			return fmt.Errorf("Router: %s: %w", route.name(), err)
+		}
+		r.setConnected(route, true)
+	}
+	return
+}
+
+// Disconnect disconnects all routes and logs their stats.
+func (r *Router) Disconnect() (err error) {
+	for _, route := range r.routes() {
+		if !route.connected {
+			continue
+		}
+		if e := route.Destination.Disconnect(); e != nil {
+			log.Errorf("Router: %s: %v", route.name(), e)
+			err = e
+		}
+		r.setConnected(route, false)
+	}
+	for _, route := range r.routes() {
+		log.Infof("Router: %s: %+v", route.name(), route.Stats())
+	}
+	log.Info("Router: unmatched messages: ", r.Unmatched())
+	return
+}
+
+// setConnected records whether the destination of `route`, and so of
+// all routes sharing it, is connected.
+func (r *Router) setConnected(route *Route, connected bool) {
+	route.connected = connected
+	for _, other := range r.routes() {
+		if sameDestination(other.Destination, route.Destination) {
+			other.connected = connected
+		}
+	}
+}
+
+func (r *Router) Info() {
+	for _, route := range r.routes() {
+		log.Infof("Router route %s (%s)", route.name(), reflect.TypeOf(route.Destination))
+		route.Destination.Info()
+	}
+}
+
+func (r *Router) Write(message string) (err error) {
+	return r.WriteMessage(NewMessage(message))
+}
+
+// WriteMessage writes `message` to the destination of the first
+// matching route.
+func (r *Router) WriteMessage(message Message) (err error) {
+	return r.WriteMessageContext(context.Background(), message)
+}
+
+// WriteMessageContext is like WriteMessage but passes ctx to the
+// destination if it is a ContextDestination.
+func (r *Router) WriteMessageContext(ctx context.Context, message Message) (err error) {
+	route := r.match(message)
+	if route == nil {
+		r.mu.Lock()
+		r.unmatched++
+		r.mu.Unlock()
+		log.Debug("Router: dropping unmatched message")
+		if r.DefersAck() {
+			message.Ack()
+		}
+		return nil
+	}
+
+	route.count(func(s *RouteStats) { s.Matched++ })
+	err = writeMessage(ctx, AsMessageDestination(route.Destination), message)
+	if err != nil {
+		route.count(func(s *RouteStats) { s.Failed++ })
+		return fmt.Errorf("Router: %s: %w", route.name(), err)
+	}
+	route.count(func(s *RouteStats) { s.Written++ })
+
+	// the route doesn't ack on its own
+	if r.DefersAck() && !defersAck(route.Destination) {
+		message.Ack()
+	}
+	return nil
+}
+
+// DefersAck reports whether any route defers acks, in which case
+// Router acks messages written to the other routes itself.
+func (r *Router) DefersAck() bool {
+	for _, route := range r.routes() {
+		if defersAck(route.Destination) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush flushes the destinations of all routes that buffer messages.
+func (r *Router) Flush(ctx context.Context) (pending int, err error) {
+	for _, dest := range r.destinations() {
+		f, ok := dest.(Flusher)
+		if !ok {
+			continue
+		}
+		n, e := f.Flush(ctx)
+		pending += n
+		if e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Stats returns the stats of each route by name, the default route
+// is named "default". A route whose name is taken by a previous one
+// is keyed by its name and index, e.g. "*stream.S3#1".
+func (r *Router) Stats() map[string]RouteStats {
+	stats := map[string]RouteStats{}
+	for i, route := range r.routes() {
+		name := route.name()
+		if _, taken := stats[name]; taken {
+			name = fmt.Sprintf("%s#%d", name, i)
+		}
+		stats[name] = route.Stats()
+	}
+	return stats
+}
+
+// Unmatched returns the number of messages dropped because they
+// matched no route and there is no default.
+func (r *Router) Unmatched() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.unmatched
+}
+
+// match returns the first route matching `message`.
+func (r *Router) match(message Message) *Route {
+	for _, route := range r.Routes {
+		if route.Match == nil || route.Match.Match(message) {
+			return route
+		}
+	}
+	return r.defaultRoute()
+}
+
+func (r *Router) defaultRoute() *Route {
+	if r.Default == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.def == nil {
+		r.def = &Route{Name: "default", Destination: r.Default}
+	}
+	return r.def
+}
+
+// routes returns all routes including the default one.
+func (r *Router) routes() []*Route {
+	routes := r.Routes
+	if def := r.defaultRoute(); def != nil {
+		routes = append(routes[:len(routes):len(routes)], def)
+	}
+	return routes
+}
+
+// destinations returns the destinations of all routes, once each.
+func (r *Router) destinations() []Destination {
+	var dests []Destination
+	for i, route := range r.routes() {
+		shared := false
+		for _, other := range r.routes()[:i] {
+			if sameDestination(other.Destination, route.Destination) {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			dests = append(dests, route.Destination)
+		}
+	}
+	return dests
+}
+
+// sameDestination reports whether `a` and `b` are the same
+// destination, e.g. the same pointer.
+func sameDestination(a, b Destination) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+func (route *Route) name() string {
+	if route.Name != "" {
+		return route.Name
+	}
+	return reflect.TypeOf(route.Destination).String()
+}
+
+// Stats returns a copy of the route's counters.
+func (route *Route) Stats() RouteStats {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	return route.stats
+}
+
+func (route *Route) count(f func(s *RouteStats)) {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	f(&route.stats)
+}
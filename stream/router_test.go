@@ -0,0 +1,76 @@
+package stream
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONFieldEquals(t *testing.T) {
+	m := JSONFieldEquals("data.items.1.level", 2)
+
+	assert.True(t, m.Match(NewMessage(`{"data":{"items":[{"level":1},{"level":2}]}}`)))
+	assert.False(t, m.Match(NewMessage(`{"data":{"items":[{"level":1}]}}`)))
+	assert.False(t, m.Match(NewMessage(`not json`)))
+}
+
+// countingDestination counts its connections.
+type countingDestination struct {
+	memoryDestination
+	connects    int
+	disconnects int
+}
+
+func (d *countingDestination) Connect() error {
+	d.connects++
+	return nil
+}
+
+func (d *countingDestination) Disconnect() error {
+	d.disconnects++
+	return nil
+}
+
+func TestRouter_WriteMessage(t *testing.T) {
+	errors, warnings, rest := &memoryDestination{}, &countingDestination{}, &memoryDestination{}
+	dest := &Router{
+		Routes: []*Route{
+			{Name: "errors", Match: JSONFieldEquals("level", "error"), Destination: errors},
+			{Name: "warnings", Match: PayloadMatches(regexp.MustCompile(`(?i)warn`)), Destination: warnings},
+			{Name: "tagged", Match: HeaderEquals("tag", "x"), Destination: warnings},
+		},
+		Default: rest,
+	}
+	assert.NoError(t, dest.Connect())
+
+	dest.Write(`{"level":"error"}`)
+	dest.Write(`{"level":"WARNING"}`)
+	dest.WriteMessage(Message{Payload: []byte("tagged"), Headers: map[string]string{"tag": "x"}})
+	dest.Write(`{"level":"info"}`)
+
+	assert.Equal(t, []string{`{"level":"error"}`}, errors.written())
+	assert.Equal(t, []string{`{"level":"WARNING"}`, "tagged"}, warnings.written())
+	assert.Equal(t, []string{`{"level":"info"}`}, rest.written())
+
+	stats := dest.Stats()
+	assert.Equal(t, uint64(1), stats["errors"].Written)
+	assert.Equal(t, uint64(1), stats["tagged"].Matched)
+	assert.Equal(t, uint64(1), stats["default"].Written)
+
+	// routes sharing a destination connect it once
+	assert.NoError(t, dest.Disconnect())
+	assert.Equal(t, 1, warnings.connects)
+	assert.Equal(t, 1, warnings.disconnects)
+}
+
+func TestRouter_Unmatched(t *testing.T) {
+	dest := &Router{
+		Routes: []*Route{
+			{Match: HeaderEquals("tag", "x"), Destination: &memoryDestination{}},
+		},
+	}
+
+	assert.NoError(t, dest.Write("a"))
+	assert.Equal(t, uint64(1), dest.Unmatched())
+}
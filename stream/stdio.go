@@ -1,35 +1,83 @@
 package stream
 
 import (
-	"strings"
-	"os"
 	"bufio"
 	"fmt"
+	"os"
+	"strings"
 )
 
-type Stdio struct{}
+type Stdio struct {
+	done chan struct{}
+}
 
 func (s *Stdio) Connect() (err error) {
+	s.done = make(chan struct{})
 	return nil
 }
 
-func (s *Stdio) Disconnect() (err error) {
+// Stop stops Read, which closes its channel.
+func (s *Stdio) Stop() (err error) {
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
 	return nil
 }
 
+func (s *Stdio) Disconnect() (err error) {
+	return s.Stop()
+}
+
 func (s *Stdio) Write(message string) (err error) {
 	_, err = fmt.Println(message)
 	return
 }
 
+// Read pushes every line of stdin into channel. The channel is
+// closed when stdin reaches EOF or Stop is called.
 func (s *Stdio) Read() (channel chan string, err error) {
 	channel = make(chan string)
+	done := s.done
+
+	// stdin can't be interrupted, so lines are read in their own
+	// goroutine and forwarded until done is closed
+	lines := make(chan string)
 	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(os.Stdin)
 		for {
-			reader := bufio.NewReader(os.Stdin)
-			text, _ := reader.ReadString('\n')
+			text, err := reader.ReadString('\n')
 			text = strings.TrimSuffix(text, "\n")
-			channel <- string(text)
+			if text != "" || err == nil {
+				select {
+				case lines <- text:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(channel)
+		for {
+			select {
+			case <-done:
+				return
+			case text, ok := <-lines:
+				if !ok {
+					return
+				}
+				select {
+				case channel <- text:
+				case <-done:
+					return
+				}
+			}
 		}
 	}()
 	return
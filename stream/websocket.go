@@ -2,8 +2,10 @@ package stream
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
+	"net/url"
+	"regexp"
 	"sync"
 	"time"
 
@@ -17,19 +19,67 @@ import (
 //   reconnect_every: n
 //   Attempt to reconnect every n time is passed.
 //
+//   connect_ack: regexp
+//   Wait for a message matching regexp after sending the OnConnect
+//   messages before using a connection.
+//
+//   connect_ack_timeout: n
+//   Give up on a connection if its ack isn't received within n.
+//
 // Example:
 //
 //   Args: map[string]string{
-//       "reconnect_every": strconv.Itoa(int(1 * time.Minute)),
+//       "reconnect_every": "12h",
+//       "connect_ack":     `"event":"subscribed"`,
 //   }
 type WebSocket struct {
 	URL    string // URL of websocket connection
 	Header http.Header
 	Args   map[string]string
-	conn   *websocket.Conn      // holds connection instance
-	swap   chan bool            // conn swap signal
-	disc   map[string]chan bool // disconnect signal map (creates multiple  channels)
-	wg     sync.WaitGroup
+	// OnConnect messages are sent right after every connection is
+	// made, e.g. to authenticate or subscribe to channels.
+	OnConnect []string
+	// OnConnectFunc, if set, returns messages sent after OnConnect
+	// ones, e.g. an auth message signed with the current time.
+	OnConnectFunc func() ([]string, error)
+	ack           *regexp.Regexp       // compiled connect_ack
+	mu            sync.Mutex           // guards conn
+	conn          *websocket.Conn      // holds connection instance
+	swap          chan bool            // conn swap signal
+	dmu           sync.Mutex           // guards disc
+	disc          map[string]chan bool // disconnect signal map, "read" is set while reading
+	wg            sync.WaitGroup
+	wmu           sync.Mutex // serializes writes, the connection supports one writer
+	health        healthState
+}
+
+// openWebSocket returns a WebSocket for a ws:// or wss:// URI. Its
+// query parameters named like options, e.g. `reconnect_every`, are
+// moved to Args, the others are kept in the URL.
+func openWebSocket(u *url.URL) (w *WebSocket, err error) {
+	w = &WebSocket{Args: map[string]string{}}
+	conn := *u
+	params := conn.Query()
+	for _, opt := range webSocketOptions {
+		if _, ok := params[opt.Name]; ok {
+			w.Args[opt.Name] = params.Get(opt.Name)
+			params.Del(opt.Name)
+		}
+	}
+	conn.RawQuery = params.Encode()
+	w.URL = conn.String()
+	return
+}
+
+var webSocketOptions = Options{
+	{Name: "reconnect_every", Type: DurationOption, Description: "swap the connection for a new one periodically, e.g. 12h"},
+	{Name: "connect_ack", Type: StringOption, Description: "regexp of the message acknowledging the OnConnect messages, not waited for if empty"},
+	{Name: "connect_ack_timeout", Type: DurationOption, Default: "10s", Description: "how long to wait for the connect_ack message"},
+}
+
+// Options returns the Args WebSocket accepts.
+func (w *WebSocket) Options() Options {
+	return webSocketOptions
 }
 
 // Info logs the websocket connection information.
@@ -41,12 +91,28 @@ func (w *WebSocket) Info() {
 // routine to reconnect periodically if `reconnect_every` is
 // in Args.
 func (w *WebSocket) Connect() (err error) {
-	err = w.newConnection()
+	err = webSocketOptions.Validate(w.Args, SourceAndDestination)
+	if err != nil {
+		return fmt.Errorf("WebSocket: %w", err)
+	}
+	w.ack = nil
+	if pattern := w.Args["connect_ack"]; pattern != "" {
+		w.ack, err = regexp.Compile(pattern)
+		if err != nil {
+			return Permanent(fmt.Errorf("WebSocket: connect_ack: %w", err))
+		}
+	}
+
+	_, err = w.newConnection(nil)
+	if err != nil {
+		return
+	}
 	w.swap = make(chan bool)
+	w.dmu.Lock()
 	w.disc = map[string]chan bool{
 		"reconnect": make(chan bool),
-		"read":      make(chan bool),
 	}
+	w.dmu.Unlock()
 
 	if _, ok := w.Args["reconnect_every"]; ok {
 		log.Info("Got `reconnect_every` arg, launching `Reconnect` goroutine...")
@@ -57,32 +123,61 @@ func (w *WebSocket) Connect() (err error) {
 	return
 }
 
+// Stop sends a disconnect signal to the Read goroutine, which
+// closes its channel, while the connection stays open for writes.
+func (w *WebSocket) Stop() (err error) {
+	w.dmu.Lock()
+	c, ok := w.disc["read"]
+	delete(w.disc, "read")
+	w.dmu.Unlock()
+	if !ok {
+		return
+	}
+
+	log.Info("WebSocket: Stop() started")
+	close(c)
+
+	// unblock a pending ReadMessage
+	if conn := w.connection(); conn != nil {
+		conn.SetReadDeadline(time.Now())
+	}
+
+	return
+}
+
 // Disconnect sends a disconnect signal so all go routines
 // and interested parties get a notification to clean up,
 // then it closes the web socket connection.
 func (w *WebSocket) Disconnect() (err error) {
 	log.Info("WebSocket: Disconnect() started")
 
-	// close connection
-	if w.conn != nil {
-		err = closeWebSocket(w.conn)
-		w.conn = nil
+	// send a disconnect signal, first so that Read doesn't
+	// reconnect when the connection is closed
+	log.Info("Sending disc signal to all channels.")
+	w.dmu.Lock()
+	for name, c := range w.disc {
+		log.Infof("Closing channel %s...", name)
+		close(c)
+		delete(w.disc, name)
 	}
+	w.dmu.Unlock()
 
-	// send a disconnect signal
-	if _, ok := w.Args["reconnect_every"]; ok {
-		log.Info("Sending disc signal to all channels.")
-		for name, c := range w.disc {
-			log.Infof("Sending to channel %s...", name)
-			c <- true
-			log.Infof("Sent disc signal to channel %s", name)
-		}
+	// close connection
+	w.mu.Lock()
+	conn := w.conn
+	w.conn = nil
+	w.mu.Unlock()
+	if conn != nil {
+		w.wmu.Lock()
+		err = closeWebSocket(conn)
+		w.wmu.Unlock()
 	}
 
 	// wait for go routines to finish
 	log.Info("Waiting for goroutines to finish...")
 	w.wg.Wait()
 	log.Info("Goroutines finished.")
+	w.health.disconnected()
 
 	return
 }
@@ -91,25 +186,23 @@ func (w *WebSocket) Disconnect() (err error) {
 // periodically.
 //
 // The default reconnect period is 1 minute, it is used
-// when the value of `reonnect_every` is not readable.
+// when `reconnect_every` is not set.
 func (w *WebSocket) Reconnect() (err error) {
 	// wait
 	reconnectEvery := 1 * time.Minute
 	// override reconnectEvery from Args
-	if val, ok := w.Args["reconnect_every"]; ok {
-		if n, err := strconv.Atoi(val); err == nil {
-			reconnectEvery = time.Duration(n)
-		} else {
-			log.Errorln(val, "is not an integer.")
-		}
+	if d := webSocketOptions.Duration(w.Args, "reconnect_every"); d > 0 {
+		reconnectEvery = d
 	}
 	log.Info("Reconnecting every ", reconnectEvery)
 
-	prevConn := w.conn
+	w.dmu.Lock()
+	disc := w.disc["reconnect"]
+	w.dmu.Unlock()
 	for {
 		// check for a disconnect signal, quit if received
 		select {
-		case <-w.disc["reconnect"]:
+		case <-disc:
 			log.Warn("Reconnect(): Received disconnect signal")
 			w.wg.Done()
 			return
@@ -117,39 +210,92 @@ func (w *WebSocket) Reconnect() (err error) {
 			log.Warn("WebSocket.Reconnect(): Swapping connections...")
 
 			// send a swapping started signal
-			w.swap <- true
-
-			// connect to a websocket connection
-			err := w.newConnection()
-			if err != nil {
-				continue
+			if !w.signalSwap(true, disc) {
+				log.Warn("Reconnect(): Received disconnect signal")
+				w.wg.Done()
+				return
 			}
 
-			log.Warn("WebSocket.Reconnect(): Connection swapped successfully.")
-			log.Trace("prevConn: ", prevConn.UnderlyingConn())
-			log.Trace("w.conn: ", w.conn.UnderlyingConn())
-			closeWebSocket(prevConn)
-			prevConn = w.conn
+			// connect to a websocket connection, the current one is
+			// kept until the next attempt if it fails
+			var prevConn *websocket.Conn
+			prevConn, err = w.newConnection(disc)
+			if err == nil {
+				websocketReconnects.Inc()
+				log.Warn("WebSocket.Reconnect(): Connection swapped successfully.")
+				// wait for writes to the previous connection
+				w.wmu.Lock()
+				closeWebSocket(prevConn)
+				w.wmu.Unlock()
+			} else {
+				log.Warn("WebSocket.Reconnect(): Keeping the current connection.")
+			}
 
 			// send a swapping stopped signal
-			w.swap <- false
+			if !w.signalSwap(false, disc) {
+				log.Warn("Reconnect(): Received disconnect signal")
+				w.wg.Done()
+				return
+			}
 		}
 	}
 }
 
+// signalSwap sends `swap` to the Read goroutine, unless there is
+// none, e.g. when WebSocket is only a destination, or it stops
+// meanwhile. It returns false if `disc` is closed first.
+func (w *WebSocket) signalSwap(swap bool, disc chan bool) bool {
+	w.dmu.Lock()
+	read, reading := w.disc["read"]
+	w.dmu.Unlock()
+	if !reading {
+		return true
+	}
+	select {
+	case w.swap <- swap:
+	case <-read:
+	case <-disc:
+		return false
+	}
+	return true
+}
+
 // Write writes `message` (transformed into bytes) to the websocket connection.
 func (w *WebSocket) Write(message string) (err error) {
-	if w.conn == nil {
-		return errors.New("w.conn is nil")
+	return w.WriteMessage(NewMessage(message))
+}
+
+// WriteMessage writes the payload of `message` to the websocket
+// connection as a binary frame if its `messageType` metadata is
+// "binary", or as a text frame otherwise.
+func (w *WebSocket) WriteMessage(message Message) (err error) {
+	messageType := websocket.TextMessage
+	if message.Metadata["messageType"] == "binary" {
+		messageType = websocket.BinaryMessage
 	}
 
-	err = w.conn.WriteMessage(websocket.TextMessage, []byte(message))
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+
+	conn := w.connection()
+	if conn == nil {
+		return errors.New("w.conn is nil")
+	}
+	err = conn.WriteMessage(messageType, message.Payload)
 	if err != nil {
 		log.Error(err)
+		return
 	}
+	w.health.wrote()
 	return
 }
 
+// Health reports whether the last connection attempt succeeded and
+// when a message was last read or written.
+func (w *WebSocket) Health() Health {
+	return w.health.get()
+}
+
 // Read launches a go routine that runs a loop to read from
 // the websocket connection.
 //
@@ -157,15 +303,36 @@ func (w *WebSocket) Write(message string) (err error) {
 // the existing connection raises an error. This is to avoid
 // repeated ReadMessage errors that would panic the process.
 // It is useful for cases when the server you are connecting
-// to drops the connection from its side. If the connection
-// attempt fails, the process exits.
+// to drops the connection from its side. Failed connection
+// attempts, e.g. without a `connect_ack`, are retried every 1
+// second, doubled after each failure up to ~1 minute.
+//
+// The channel is closed after Stop or Disconnect is called.
 func (w *WebSocket) Read() (channel chan string, err error) {
-	channel = make(chan string)
+	messages, err := w.ReadMessages()
+	if err != nil {
+		return
+	}
+	return payloads(messages), nil
+}
+
+// ReadMessages is like Read but pushes messages whose `messageType`
+// metadata tells text frames from binary ones.
+func (w *WebSocket) ReadMessages() (channel chan Message, err error) {
+	channel = make(chan Message)
+	w.dmu.Lock()
+	disc, ok := w.disc["read"]
+	if !ok {
+		disc = make(chan bool)
+		w.disc["read"] = disc
+	}
+	w.dmu.Unlock()
 	w.wg.Add(1)
 	go func() {
+		defer close(channel)
 		for {
 			select {
-			case <-w.disc["read"]:
+			case <-disc:
 				log.Warn("Read(): Received disconnect signal")
 				w.wg.Done()
 				return
@@ -174,32 +341,56 @@ func (w *WebSocket) Read() (channel chan string, err error) {
 				log.Tracef("swap signal received: %t", swap)
 				// if swap started (true), wait for a false signal
 				if swap {
-					_ = <-w.swap
-					// swap is done
+					select {
+					case <-w.swap:
+						// swap is done
+					case <-disc:
+					}
 				}
 				// continue to next iteration
 				continue
 			default:
 				// no disc or swap signal received
-				if w.conn != nil {
-					log.Trace("Read() iteration, w.conn: ", w.conn.UnderlyingConn())
-
-					_, messageBytes, err := w.conn.ReadMessage()
-					log.Debug("ReadMessage() done")
-					if err != nil {
-						log.Warning("ReadMessage() error: ", err)
+				conn := w.connection()
+				if conn == nil {
+					// the connection was never established
+					w.redial(disc)
+					continue
+				}
+				log.Trace("Read() iteration, w.conn: ", conn.UnderlyingConn())
 
-						if w.conn != nil {
-							// ReadMessage() should not receive an error as Disconnect() nullifies w.conn
-							w.newConnection()
-						}
+				messageType, messageBytes, err := conn.ReadMessage()
+				log.Debug("ReadMessage() done")
+				if err != nil {
+					log.Warning("ReadMessage() error: ", err)
 
+					// don't reconnect if a disconnect signal was sent
+					select {
+					case <-disc:
 						continue
+					default:
 					}
 
-					log.Debug("trying to push messageBytes into channel")
-					channel <- string(messageBytes)
+					w.redial(disc)
+					continue
+				}
+
+				w.health.read()
+				log.Debug("trying to push messageBytes into channel")
+				message := Message{
+					Payload:   messageBytes,
+					Timestamp: time.Now(),
+					Metadata:  map[string]string{"messageType": "text"},
+				}
+				if messageType == websocket.BinaryMessage {
+					message.Metadata["messageType"] = "binary"
+				}
+
+				select {
+				case channel <- message:
 					log.Debug("channel <- messageBytes successful")
+				case <-disc:
+					continue
 				}
 			}
 		}
@@ -207,22 +398,115 @@ func (w *WebSocket) Read() (channel chan string, err error) {
 	return
 }
 
-// newConnection attempts to connect the URL in WebSocket
-// and return a connection.
-func (w *WebSocket) newConnection() (err error) {
+// newConnection attempts to connect the URL in WebSocket and, once
+// the OnConnect messages are sent and acknowledged, makes it the
+// current connection. It returns the connection it replaced, if any,
+// which is left open. The current connection is kept if the attempt
+// fails or `disc` is closed meanwhile.
+func (w *WebSocket) newConnection(disc chan bool) (prev *websocket.Conn, err error) {
 	log.Info("Establishing websocket connection...")
-	var conn *websocket.Conn
-	conn, _, err = websocket.DefaultDialer.Dial(w.URL, w.Header)
-	w.conn = conn
+	conn, _, err := websocket.DefaultDialer.Dial(w.URL, w.Header)
 	if err == nil {
-		log.Info("Websocket connection established.")
-	} else {
-		log.Error("WebSocket.newConnection: websocket.Dial: ", err)
+		err = w.handshake(conn)
+		if err != nil {
+			conn.Close()
+		}
 	}
+	if err != nil {
+		log.Error("WebSocket.newConnection: ", err)
+		w.health.connected(err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-disc:
+		conn.Close()
+		return nil, errors.New("WebSocket: disconnected while connecting")
+	default:
+	}
+	prev, w.conn = w.conn, conn
+	w.health.connected(nil)
+	log.Info("Websocket connection established.")
 	return
 }
 
-// closeWebSocket closes the websocet connection in `conn`.
+// redial replaces the current connection, e.g. after the server
+// closed it, until it succeeds or `disc` is closed. Attempts are 1
+// second apart, doubled after each failure up to ~1 minute.
+func (w *WebSocket) redial(disc chan bool) {
+	sleep := time.Second
+	for {
+		prev, err := w.newConnection(disc)
+		if err == nil {
+			websocketReconnects.Inc()
+			if prev != nil {
+				prev.Close()
+			}
+			return
+		}
+
+		log.Info("WebSocket: Reconnecting in ", sleep)
+		select {
+		case <-disc:
+			return
+		case <-time.After(sleep):
+		}
+		if sleep < time.Minute {
+			sleep *= 2
+		}
+	}
+}
+
+// connection returns the current connection, which Reconnect and
+// Read may replace at any time.
+func (w *WebSocket) connection() *websocket.Conn {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn
+}
+
+// handshake sends the OnConnect messages on `conn`, which isn't used
+// by anything else yet, and waits for the `connect_ack` message.
+func (w *WebSocket) handshake(conn *websocket.Conn) (err error) {
+	messages := w.OnConnect
+	if w.OnConnectFunc != nil {
+		var more []string
+		more, err = w.OnConnectFunc()
+		if err != nil {
+			return fmt.Errorf("OnConnectFunc: %w", err)
+		}
+		messages = append(messages[:len(messages):len(messages)], more...)
+	}
+	for _, message := range messages {
+		err = conn.WriteMessage(websocket.TextMessage, []byte(message))
+		if err != nil {
+			return
+		}
+	}
+	if w.ack == nil {
+		return
+	}
+
+	timeout := webSocketOptions.Duration(w.Args, "connect_ack_timeout")
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		var message []byte
+		_, message, err = conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("waiting for connect_ack: %w", err)
+		}
+		if w.ack.Match(message) {
+			break
+		}
+		log.Debug("WebSocket: Skipping message received before connect_ack: ", string(message))
+	}
+	return conn.SetReadDeadline(time.Time{})
+}
+
+// closeWebSocket closes the websocet connection in `conn`, after
+// sending a close message.
 func closeWebSocket(conn *websocket.Conn) (err error) {
 	if conn == nil {
 		err = errors.New("conn is nil")
@@ -231,6 +515,7 @@ func closeWebSocket(conn *websocket.Conn) (err error) {
 
 	log.Info("Closing websocket connection...")
 	err = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
 	if err != nil {
 		log.Error("Websocket write close error: ", err)
 		return
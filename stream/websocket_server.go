@@ -0,0 +1,366 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// WebSocketServer accepts WebSocket connections on Path and broadcasts
+// the messages written to it to all connected clients, e.g. to feed
+// live dashboards.
+//
+// Clients may subscribe to some messages only with `topic` query
+// parameters, e.g. ws://host:8080/live?topic=orders&topic=payments,
+// which are matched against the message key.
+type WebSocketServer struct {
+	Addr     string // address to listen on, e.g. ":8080"
+	Path     string // "/" if empty
+	Args     map[string]string
+	server   *http.Server
+	listener net.Listener
+	upgrader websocket.Upgrader
+	mu       sync.Mutex // guards clients
+	clients  map[*wsClient]bool
+	health   healthState
+}
+
+var webSocketServerOptions = Options{
+	{Name: "bufferSize", Type: IntOption, Default: "256", Description: "messages buffered for each client"},
+	{Name: "slowClient", Type: StringOption, Default: "disconnect", Description: "what happens when the buffer of a client is full: disconnect it, or drop the message for it"},
+	{Name: "maxClients", Type: IntOption, Description: "maximum number of clients, 0 for no limit"},
+	{Name: "pingInterval", Type: DurationOption, Default: "30s", Description: "how often clients are pinged"},
+	{Name: "pongTimeout", Type: DurationOption, Default: "60s", Description: "time after which a client that didn't answer pings is disconnected"},
+	{Name: "writeTimeout", Type: DurationOption, Default: "10s", Description: "time limit of writing a message to a client"},
+	{Name: "drainTimeout", Type: DurationOption, Default: "5s", Description: "how long Disconnect keeps sending the messages buffered for clients"},
+	{Name: "allowedOrigins", Type: StringOption, Description: "comma separated origins browsers may connect from, * for any, the server's own if empty"},
+}
+
+// Options returns the Args WebSocketServer accepts.
+func (s *WebSocketServer) Options() Options {
+	return webSocketServerOptions
+}
+
+// Connect starts listening for clients.
+func (s *WebSocketServer) Connect() (err error) {
+	err = webSocketServerOptions.Validate(s.Args, DestinationOnly)
+	if err != nil {
+		return fmt.Errorf("WebSocketServer: %w", err)
+	}
+	switch policy := webSocketServerOptions.String(s.Args, "slowClient"); policy {
+	case "disconnect", "drop":
+	default:
+		return Permanent(fmt.Errorf("WebSocketServer: slowClient must be disconnect or drop, not %q", policy))
+	}
+
+	s.upgrader = websocket.Upgrader{}
+	if origins := s.Args["allowedOrigins"]; origins != "" {
+		allowed := map[string]bool{}
+		for _, origin := range strings.Split(origins, ",") {
+			allowed[strings.TrimSpace(origin)] = true
+		}
+		s.upgrader.CheckOrigin = func(r *http.Request) bool {
+			return allowed["*"] || allowed[r.Header.Get("Origin")]
+		}
+	}
+	path := s.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, s.handle)
+	s.server = &http.Server{Handler: mux}
+	s.clients = map[*wsClient]bool{}
+
+	s.listener, err = net.Listen("tcp", s.Addr)
+	if err != nil {
+		log.Error("WebSocketServer: Failed to listen: ", err)
+		s.health.connected(err)
+		return
+	}
+	log.Infof("WebSocketServer: Listening on %s%s", s.listener.Addr(), path)
+	go func(server *http.Server, listener net.Listener) {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("WebSocketServer: ", err)
+			s.health.connected(err)
+		}
+	}(s.server, s.listener)
+	s.health.connected(nil)
+
+	return
+}
+
+// Disconnect stops listening and closes the connections of all
+// clients once the messages buffered for them are sent, or
+// `drainTimeout` expires.
+func (s *WebSocketServer) Disconnect() (err error) {
+	if s.server == nil {
+		log.Warn("WebSocketServer.Disconnect(): server is nil")
+		return
+	}
+
+	log.Info("Stopping WebSocket server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.server.Shutdown(ctx)
+
+	deadline := time.Now().Add(webSocketServerOptions.Duration(s.Args, "drainTimeout"))
+	s.mu.Lock()
+	clients := s.clients
+	for c := range clients {
+		c.close(websocket.CloseGoingAway, deadline)
+	}
+	webSocketClients.Sub(float64(len(clients)))
+	s.clients = nil
+	s.mu.Unlock()
+	expired := time.After(time.Until(deadline))
+wait:
+	for c := range clients {
+		select {
+		case <-c.closed:
+		case <-expired:
+			log.Warn("WebSocketServer: Drain deadline exceeded with messages still buffered for clients.")
+			break wait
+		}
+	}
+
+	s.server = nil
+	s.health.disconnected()
+	log.Info("WebSocket server stopped.")
+
+	return
+}
+
+// ListenAddr returns the address the server listens on, which has
+// the actual port if Addr has port 0.
+func (s *WebSocketServer) ListenAddr() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Health reports whether the server is listening, when a message
+// was last broadcast, and how many messages are buffered for
+// clients.
+func (s *WebSocketServer) Health() Health {
+	h := s.health.get()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		h.Backlog += len(c.send)
+	}
+	return h
+}
+
+func (s *WebSocketServer) Info() {
+	log.Info("Addr: ", s.Addr)
+	log.Info("Path: ", s.Path)
+	log.Info("Args: ", s.Args)
+}
+
+func (s *WebSocketServer) Write(message string) (err error) {
+	return s.WriteMessage(NewMessage(message))
+}
+
+// WriteMessage adds `message` to the buffer of every client
+// subscribed to its key, without waiting for it to be sent. It is
+// sent as a binary frame if its `messageType` metadata is "binary",
+// or as a text frame otherwise.
+//
+// A client whose buffer is full is disconnected, or with `slowClient`
+// set to "drop", misses the message.
+func (s *WebSocketServer) WriteMessage(message Message) (err error) {
+	drop := webSocketServerOptions.String(s.Args, "slowClient") == "drop"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		if !c.subscribed(message.Key) {
+			continue
+		}
+		select {
+		case c.send <- message:
+		default:
+			webSocketDropped.Inc()
+			if !drop {
+				log.Warn("WebSocketServer: Disconnecting slow client ", c.conn.RemoteAddr())
+				s.remove(c, websocket.ClosePolicyViolation)
+			}
+		}
+	}
+	s.health.wrote()
+
+	return
+}
+
+func (s *WebSocketServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	max := webSocketServerOptions.Int(s.Args, "maxClients")
+	full := max > 0 && len(s.clients) >= max
+	s.mu.Unlock()
+	if full {
+		http.Error(w, "too many clients", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade responded already
+		log.Warn("WebSocketServer: Upgrade failed: ", err)
+		return
+	}
+	c := &wsClient{
+		conn:   conn,
+		send:   make(chan Message, webSocketServerOptions.Int(s.Args, "bufferSize")),
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	if topics := r.URL.Query()["topic"]; len(topics) > 0 {
+		c.topics = map[string]bool{}
+		for _, topic := range topics {
+			c.topics[topic] = true
+		}
+	}
+
+	s.mu.Lock()
+	if s.clients == nil {
+		// disconnected meanwhile
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.clients[c] = true
+	webSocketClients.Inc()
+	s.mu.Unlock()
+	log.Info("WebSocketServer: Client connected from ", conn.RemoteAddr())
+
+	go s.writeLoop(c)
+	s.readLoop(c)
+}
+
+// readLoop reads from `c` to process control frames, until it fails
+// or `c` doesn't answer pings in time. Clients aren't expected to
+// send data.
+func (s *WebSocketServer) readLoop(c *wsClient) {
+	pongTimeout := webSocketServerOptions.Duration(s.Args, "pongTimeout")
+	c.conn.SetReadLimit(4096)
+	c.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			log.Info("WebSocketServer: Client disconnected: ", err)
+			s.mu.Lock()
+			s.remove(c, websocket.CloseNormalClosure)
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// writeLoop sends the messages buffered for `c` and pings it.
+func (s *WebSocketServer) writeLoop(c *wsClient) {
+	writeTimeout := webSocketServerOptions.Duration(s.Args, "writeTimeout")
+	ping := time.NewTicker(webSocketServerOptions.Duration(s.Args, "pingInterval"))
+	defer close(c.closed)
+	defer ping.Stop()
+	defer c.conn.Close()
+
+	for {
+		select {
+		case message := <-c.send:
+			if err := c.write(message, time.Now().Add(writeTimeout)); err != nil {
+				log.Warn("WebSocketServer: Failed to write to client: ", err)
+				return
+			}
+		case <-ping.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+			if err != nil {
+				log.Warn("WebSocketServer: Failed to ping client: ", err)
+				return
+			}
+		case <-c.done:
+			c.flush(writeTimeout)
+			c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(c.code, ""), time.Now().Add(writeTimeout))
+			return
+		}
+	}
+}
+
+// remove stops sending to `c`, which is closed with `code`. s.mu must
+// be held.
+func (s *WebSocketServer) remove(c *wsClient, code int) {
+	if !s.clients[c] {
+		return
+	}
+	delete(s.clients, c)
+	webSocketClients.Dec()
+	c.close(code, time.Time{})
+}
+
+// wsClient is a client of a WebSocketServer.
+type wsClient struct {
+	conn   *websocket.Conn
+	send   chan Message    // messages to send
+	topics map[string]bool // keys of the messages to send, all if nil
+	done   chan struct{}   // closed to disconnect the client
+	code   int             // close code, set before done is closed
+	drain  time.Time       // buffered messages are sent until then, set with code
+	closed chan struct{}   // closed once the connection is closed
+	once   sync.Once
+}
+
+func (c *wsClient) subscribed(key string) bool {
+	return c.topics == nil || c.topics[key]
+}
+
+// close disconnects the client with `code`, after sending the
+// messages buffered for it until `drain`.
+func (c *wsClient) close(code int, drain time.Time) {
+	c.once.Do(func() {
+		c.code = code
+		c.drain = drain
+		close(c.done)
+	})
+}
+
+// write sends `message` as a binary frame if its `messageType`
+// metadata is "binary", as a text frame otherwise.
+func (c *wsClient) write(message Message, deadline time.Time) error {
+	messageType := websocket.TextMessage
+	if message.Metadata["messageType"] == "binary" {
+		messageType = websocket.BinaryMessage
+	}
+	c.conn.SetWriteDeadline(deadline)
+	return c.conn.WriteMessage(messageType, message.Payload)
+}
+
+// flush sends the messages buffered for the client until none is
+// left or its drain deadline expires.
+func (c *wsClient) flush(writeTimeout time.Duration) {
+	for time.Now().Before(c.drain) {
+		select {
+		case message := <-c.send:
+			deadline := time.Now().Add(writeTimeout)
+			if c.drain.Before(deadline) {
+				deadline = c.drain
+			}
+			if err := c.write(message, deadline); err != nil {
+				log.Warn("WebSocketServer: Failed to write to client: ", err)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// dial connects to `s` and waits until it counts `n` clients.
+func dial(t *testing.T, s *WebSocketServer, query string, n int) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+s.ListenAddr()+"/live"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForClients(s, n)
+	return conn
+}
+
+// waitForClients waits up to 2 seconds for `s` to count `n` clients
+// and returns its count.
+func waitForClients(s *WebSocketServer, n int) int {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		clients := clientCount(s)
+		if clients == n || time.Now().After(deadline) {
+			return clients
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func clientCount(s *WebSocketServer) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+func TestWebSocketServer_BroadcastWithTopics(t *testing.T) {
+	s := &WebSocketServer{Addr: "127.0.0.1:0", Path: "/live"}
+	if !assert.NoError(t, s.Connect()) {
+		return
+	}
+	defer s.Disconnect()
+
+	all := dial(t, s, "", 1)
+	defer all.Close()
+	orders := dial(t, s, "?topic=orders", 2)
+	defer orders.Close()
+
+	assert.NoError(t, s.WriteMessage(Message{Payload: []byte("o1"), Key: "orders"}))
+	assert.NoError(t, s.WriteMessage(Message{Payload: []byte("p1"), Key: "payments"}))
+	assert.NoError(t, s.WriteMessage(Message{Payload: []byte{0, 1}, Key: "orders", Metadata: map[string]string{"messageType": "binary"}}))
+
+	read := func(conn *websocket.Conn) (int, string) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		messageType, p, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		return messageType, string(p)
+	}
+	for _, expected := range []string{"o1", "p1", "\x00\x01"} {
+		_, p := read(all)
+		assert.Equal(t, expected, p)
+	}
+	_, p := read(orders)
+	assert.Equal(t, "o1", p)
+	messageType, p := read(orders)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	assert.Equal(t, "\x00\x01", p)
+}
+
+func TestWebSocketServer_EvictsSlowClients(t *testing.T) {
+	s := &WebSocketServer{Addr: "127.0.0.1:0", Path: "/live", Args: map[string]string{"bufferSize": "1", "writeTimeout": "100ms"}}
+	if !assert.NoError(t, s.Connect()) {
+		return
+	}
+	defer s.Disconnect()
+
+	// a client that doesn't read fills its socket, then its buffer
+	conn := dial(t, s, "", 1)
+	defer conn.Close()
+	payload := bytes.Repeat([]byte("x"), 1<<20)
+	for i := 0; i < 64; i++ {
+		assert.NoError(t, s.WriteMessage(Message{Payload: payload}))
+		if clientCount(s) == 0 {
+			return
+		}
+	}
+	t.Error("slow client not evicted")
+}
+
+func TestWebSocketServer_DisconnectsUnresponsiveClients(t *testing.T) {
+	s := &WebSocketServer{Addr: "127.0.0.1:0", Path: "/live", Args: map[string]string{"pingInterval": "20ms", "pongTimeout": "100ms"}}
+	if !assert.NoError(t, s.Connect()) {
+		return
+	}
+	defer s.Disconnect()
+
+	// reading answers pings
+	alive := dial(t, s, "", 1)
+	defer alive.Close()
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// not reading doesn't
+	silent := dial(t, s, "", 2)
+	defer silent.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 1, waitForClients(s, 1))
+}
+
+func TestWebSocketServer_DisconnectDrainsClients(t *testing.T) {
+	s := &WebSocketServer{Addr: "127.0.0.1:0", Path: "/live"}
+	if !assert.NoError(t, s.Connect()) {
+		return
+	}
+	conn := dial(t, s, "", 1)
+	defer conn.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, s.WriteMessage(Message{Payload: []byte("m")}))
+	}
+	disconnected := make(chan error)
+	go func() {
+		disconnected <- s.Disconnect()
+	}()
+
+	// buffered messages are sent before the connection is closed
+	var received int
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+			break
+		}
+		received++
+	}
+	assert.Equal(t, 100, received)
+	assert.NoError(t, <-disconnected)
+}
@@ -6,11 +6,14 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 )
 
 var upgrader = websocket.Upgrader{}
@@ -68,6 +71,37 @@ func TestWebSocket_ReadWrite(t *testing.T) {
 	}
 }
 
+func TestWebSocket_ReadWriteMessage(t *testing.T) {
+	// Create test server with the echo handler.
+	server := httptest.NewServer(http.HandlerFunc(echo))
+	defer server.Close()
+
+	src := &WebSocket{
+		URL:    "ws" + strings.TrimPrefix(server.URL, "http"),
+		Header: http.Header{},
+	}
+	src.Connect()
+	defer src.Disconnect()
+
+	messages, err := src.ReadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = src.WriteMessage(Message{
+		Payload:  []byte{0x00, 0xff},
+		Metadata: map[string]string{"messageType": "binary"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-messages
+	if m.Metadata["messageType"] != "binary" || string(m.Payload) != "\x00\xff" {
+		t.Errorf("unexpected message: %+v", m)
+	}
+}
+
 func TestWebSocket_Reconnect(t *testing.T) {
 	// Create test server with the echo handler.
 	server := httptest.NewServer(http.HandlerFunc(echo))
@@ -97,6 +131,39 @@ func TestWebSocket_Reconnect(t *testing.T) {
 	src.Disconnect()
 }
 
+func TestWebSocket_ReconnectDestination(t *testing.T) {
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connections, 1)
+		echo(w, r)
+	}))
+	defer server.Close()
+
+	// without a Read goroutine to signal, connections are swapped
+	// all the same
+	dest := &WebSocket{
+		URL:  "ws" + strings.TrimPrefix(server.URL, "http"),
+		Args: map[string]string{"reconnect_every": "50ms"},
+	}
+	if err := dest.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	assert.NoError(t, dest.Write("echo"))
+	assert.Greater(t, atomic.LoadInt32(&connections), int32(2))
+
+	disconnected := make(chan struct{})
+	go func() {
+		dest.Disconnect()
+		close(disconnected)
+	}()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Disconnect did not return")
+	}
+}
+
 func TestWebSocket_ReconnectConnectionClosed(t *testing.T) {
 	// log.SetLevel(log.TraceLevel5
 	// Create test server with the echo handler.
@@ -168,3 +235,147 @@ func echoCloseMidStream(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// subscribeServer answers an "auth" message with an ack, then echoes
+// messages once subscribed, and drops each connection after echoing
+// "drop". The first messages of each connection are sent to
+// `handshakes`.
+func subscribeServer(handshakes chan []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		var received []string
+		for len(received) < 2 {
+			_, message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			received = append(received, string(message))
+			if string(message) == "auth" {
+				c.WriteMessage(websocket.TextMessage, []byte(`{"event":"info"}`))
+				c.WriteMessage(websocket.TextMessage, []byte(`{"event":"authenticated"}`))
+			}
+		}
+		handshakes <- received
+
+		for {
+			mt, message, err := c.ReadMessage()
+			if err != nil || c.WriteMessage(mt, message) != nil || string(message) == "drop" {
+				return
+			}
+		}
+	}
+}
+
+func TestWebSocket_OnConnectReplayedOnReconnect(t *testing.T) {
+	handshakes := make(chan []string, 2)
+	server := httptest.NewServer(subscribeServer(handshakes))
+	defer server.Close()
+
+	var calls int
+	src := &WebSocket{
+		URL:       "ws" + strings.TrimPrefix(server.URL, "http"),
+		OnConnect: []string{"auth"},
+		OnConnectFunc: func() ([]string, error) {
+			calls++
+			return []string{"subscribe " + strconv.Itoa(calls)}, nil
+		},
+		Args: map[string]string{"connect_ack": `"authenticated"`},
+	}
+	if err := src.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer src.Disconnect()
+	assert.Equal(t, []string{"auth", "subscribe 1"}, <-handshakes)
+
+	messages, err := src.ReadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server drops the connection after echoing "drop", which
+	// Read replaces with a new one
+	src.Write("drop")
+	assert.Equal(t, "drop", receive(t, messages).String())
+	assert.Equal(t, []string{"auth", "subscribe 2"}, <-handshakes)
+}
+
+func TestWebSocket_ConnectAckTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(echo))
+	defer server.Close()
+
+	src := &WebSocket{
+		URL:       "ws" + strings.TrimPrefix(server.URL, "http"),
+		OnConnect: []string{"subscribe"},
+		Args:      map[string]string{"connect_ack": "^subscribed$", "connect_ack_timeout": "100ms"},
+	}
+	// the echoed "subscribe" doesn't match
+	assert.Error(t, src.Connect())
+	assert.False(t, src.Health().Connected)
+	src.Disconnect()
+}
+
+func TestWebSocket_RedialAfterFailedAck(t *testing.T) {
+	var mu sync.Mutex
+	var connections int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		mu.Lock()
+		connections++
+		n := connections
+		mu.Unlock()
+
+		if _, _, err := c.ReadMessage(); err != nil {
+			return
+		}
+		// the second connection isn't acknowledged
+		if n != 2 {
+			c.WriteMessage(websocket.TextMessage, []byte("subscribed"))
+		}
+		for {
+			mt, message, err := c.ReadMessage()
+			if err != nil || c.WriteMessage(mt, message) != nil || string(message) == "drop" {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	src := &WebSocket{
+		URL:       "ws" + strings.TrimPrefix(server.URL, "http"),
+		OnConnect: []string{"subscribe"},
+		Args:      map[string]string{"connect_ack": "^subscribed$", "connect_ack_timeout": "100ms"},
+	}
+	if err := src.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer src.Disconnect()
+	messages, err := src.ReadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src.Write("drop")
+	assert.Equal(t, "drop", receive(t, messages).String())
+
+	// the second connection isn't acked, Read tries again
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := connections
+		mu.Unlock()
+		if n == 3 && src.Health().Connected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, src.Write("after"))
+	assert.Equal(t, "after", receive(t, messages).String())
+}